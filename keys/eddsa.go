@@ -0,0 +1,369 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/frumioj/crypto11"
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS11 v3.0 values for EdDSA keys, which are not defined by the
+// pkcs11 package.
+const (
+	ckkEcEdwards           = 0x00000040
+	ckmEcEdwardsKeyPairGen = 0x00001055
+	ckmEddsa               = 0x00001057
+)
+
+// findObjectsMax is the number of object handles fetched from the
+// token per call to C_FindObjects.
+const findObjectsMax = 100
+
+// ed25519Params is the DER-encoded object identifier for Ed25519
+// (RFC 8410), used as the CKA_EC_PARAMS of Ed25519 keys.
+var ed25519Params, _ = asn1.Marshal(asn1.ObjectIdentifier{1, 3, 101, 112})
+
+// errTokenNotFound is returned when no slot holds the token named in
+// the PKCS11 configuration.
+var errTokenNotFound = errors.New("could not find PKCS11 token")
+
+// eddsaToken is a PKCS11 session on the keyring token used for
+// Ed25519 keys, which the crypto11 package does not support. All
+// operations on the session are serialised by the mutex. A nil
+// eddsaToken is a token on which Ed25519 keys cannot be used: it
+// holds no keys, and cannot generate them.
+type eddsaToken struct {
+	mtx     sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+}
+
+// eddsaSigner implements crypto11.Signer for an Ed25519 key pair on
+// a PKCS11 token. Signing is done by the token using CKM_EDDSA over
+// the whole message, so no prior hashing is required.
+type eddsaSigner struct {
+	token  *eddsaToken
+	priv   pkcs11.ObjectHandle
+	pub    pkcs11.ObjectHandle
+	label  string
+	public ed25519.PublicKey
+}
+
+// openEddsaToken opens a session on the token described by the given
+// crypto11 configuration, and logs in to it. The PKCS11 module will
+// usually have been initialized already by crypto11, so that, and
+// an existing login, are not treated as errors.
+func openEddsaToken(cfg *crypto11.Config) (*eddsaToken, error) {
+
+	ctx := pkcs11.New(cfg.Path)
+
+	if ctx == nil {
+		return nil, errors.New("could not load PKCS11 module: " + cfg.Path)
+	}
+
+	err := ctx.Initialize()
+
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		return nil, err
+	}
+
+	slot, err := findSlot(ctx, cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !cfg.LoginNotSupported {
+		err = ctx.Login(session, pkcs11.CKU_USER, cfg.Pin)
+
+		if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			return nil, err
+		}
+	}
+
+	return &eddsaToken{ctx: ctx, session: session}, nil
+}
+
+// findSlot returns the slot holding the token given in the
+// configuration, by slot number, serial number or label.
+func findSlot(ctx *pkcs11.Ctx, cfg *crypto11.Config) (uint, error) {
+
+	slots, err := ctx.GetSlotList(true)
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, slot := range slots {
+		if cfg.SlotNumber != nil {
+			if uint(*cfg.SlotNumber) == slot {
+				return slot, nil
+			}
+			continue
+		}
+
+		info, err := ctx.GetTokenInfo(slot)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if (len(cfg.TokenSerial) > 0 && info.SerialNumber == cfg.TokenSerial) ||
+			(len(cfg.TokenLabel) > 0 && info.Label == cfg.TokenLabel) {
+			return slot, nil
+		}
+	}
+
+	return 0, errTokenNotFound
+}
+
+// eddsaUnsupported returns true if the error from a PKCS11 call
+// means that the token does not support EdDSA keys (which were only
+// added in PKCS11 v3.0), rather than that the call itself failed.
+func eddsaUnsupported(err error) bool {
+	switch err {
+	case pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID),
+		pkcs11.Error(pkcs11.CKR_ATTRIBUTE_VALUE_INVALID),
+		pkcs11.Error(pkcs11.CKR_TEMPLATE_INCONSISTENT),
+		pkcs11.Error(pkcs11.CKR_FUNCTION_NOT_SUPPORTED):
+		return true
+	default:
+		return false
+	}
+}
+
+// generate creates a new Ed25519 key pair on the token with the given
+// ID and label.
+func (t *eddsaToken) generate(id []byte, label []byte) (*eddsaSigner, error) {
+
+	if t == nil {
+		return nil, ErrUnsupportedKey
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	public := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, ckkEcEdwards),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ed25519Params),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+
+	private := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, ckkEcEdwards),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmEcEdwardsKeyPairGen, nil)}
+	pub, priv, err := t.ctx.GenerateKeyPair(t.session, mech, public, private)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t.signer(priv, pub, string(label))
+}
+
+// find returns the Ed25519 key pairs on the token with the given
+// label, or all Ed25519 key pairs if the label is nil. A token which
+// does not support EdDSA keys has none.
+func (t *eddsaToken) find(label []byte) ([]*eddsaSigner, error) {
+
+	if t == nil {
+		return nil, nil
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, ckkEcEdwards),
+	}
+
+	if label != nil {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+	}
+
+	privs, err := t.findObjects(template)
+
+	if eddsaUnsupported(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var signers []*eddsaSigner
+
+	for _, priv := range privs {
+		attrs, err := t.ctx.GetAttributeValue(t.session, priv, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		// The public half is found by its matching CKA_ID
+		pubs, err := t.findObjects([]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, ckkEcEdwards),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, attrs[0].Value),
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(pubs) == 0 {
+			log.Printf("Skipping Ed25519 key %s with no public key", string(attrs[1].Value))
+			continue
+		}
+
+		signer, err := t.signer(priv, pubs[0], string(attrs[1].Value))
+
+		if err != nil {
+			return nil, err
+		}
+
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+// findObjects returns the handles of every object on the token which
+// matches the template. The caller must hold the token lock.
+func (t *eddsaToken) findObjects(template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+
+	err := t.ctx.FindObjectsInit(t.session, template)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var handles []pkcs11.ObjectHandle
+
+	for {
+		found, _, err := t.ctx.FindObjects(t.session, findObjectsMax)
+
+		if err != nil {
+			t.ctx.FindObjectsFinal(t.session)
+			return nil, err
+		}
+
+		if len(found) == 0 {
+			break
+		}
+
+		handles = append(handles, found...)
+	}
+
+	return handles, t.ctx.FindObjectsFinal(t.session)
+}
+
+// signer reads the public key of a key pair and returns an
+// eddsaSigner for it. The caller must hold the token lock.
+func (t *eddsaToken) signer(priv pkcs11.ObjectHandle, pub pkcs11.ObjectHandle, label string) (*eddsaSigner, error) {
+
+	attrs, err := t.ctx.GetAttributeValue(t.session, pub, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := unmarshalEd25519Point(attrs[0].Value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &eddsaSigner{token: t, priv: priv, pub: pub, label: label, public: public}, nil
+}
+
+// unmarshalEd25519Point returns the public key from a CKA_EC_POINT
+// value, which tokens give either as the raw 32 bytes of the key, or
+// DER-encoded as an octet string.
+func unmarshalEd25519Point(point []byte) (ed25519.PublicKey, error) {
+
+	if len(point) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(point), nil
+	}
+
+	var raw []byte
+	rest, err := asn1.Unmarshal(point, &raw)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) > 0 || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+
+	return ed25519.PublicKey(raw), nil
+}
+
+// Public returns the ed25519.PublicKey of the key pair.
+func (s *eddsaSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs the whole message with the private key, on the token.
+func (s *eddsaSigner) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+
+	s.token.mtx.Lock()
+	defer s.token.mtx.Unlock()
+
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmEddsa, nil)}
+	err := s.token.ctx.SignInit(s.token.session, mech, s.priv)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.token.ctx.Sign(s.token.session, msg)
+}
+
+// Delete removes both halves of the key pair from the token.
+func (s *eddsaSigner) Delete() error {
+
+	s.token.mtx.Lock()
+	defer s.token.mtx.Unlock()
+
+	err := s.token.ctx.DestroyObject(s.token.session, s.priv)
+
+	if err != nil {
+		return err
+	}
+
+	return s.token.ctx.DestroyObject(s.token.session, s.pub)
+}
@@ -6,8 +6,10 @@ require (
 	github.com/btcsuite/btcd v0.22.0-beta
 	github.com/cosmos/cosmos-sdk v0.43.0
 	github.com/frumioj/crypto11 v1.2.5-0.20210823151709-946ce662cc0e
+	github.com/miekg/pkcs11 v1.0.3-0.20190429190417-a667d056470f
 	github.com/stretchr/testify v1.7.0
 	github.com/tendermint/tendermint v0.34.12 // indirect
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 )
 
 replace github.com/gogo/protobuf => github.com/regen-network/protobuf v1.3.3-alpha.regen.1
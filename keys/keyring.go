@@ -10,20 +10,39 @@
 package keys
 
 import (
+	"bytes"
 	"crypto/elliptic"
 	"crypto/rand"
+	"encoding/asn1"
 	"encoding/json"
+	"errors"
 	"log"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/frumioj/crypto11"
+	"github.com/miekg/pkcs11"
 )
 
+// DER-encoded object identifiers of the curves supported for ECDSA
+// keys, as found in the CKA_EC_PARAMS of keys on the token.
+var (
+	secp256k1Params, _ = asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 10})
+	secp256r1Params, _ = asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7})
+)
+
+// ErrKeyNotFound is returned when a keyring holds no key with the
+// requested label.
+var ErrKeyNotFound = errors.New("key not found")
+
 type Pkcs11Keyring struct {
 	ModulePath string
 	TokenLabel string
 	pin        string
 	ctx        *crypto11.Context
+	eddsa      *eddsaToken
+	newKeyMtx  *sync.Mutex
 }
 
 // Keyring interface provides the methods for keyring
@@ -36,16 +55,54 @@ type Pkcs11Keyring struct {
 type Keyring interface {
 	NewKey(algorithm KeygenAlgorithm, label string) (*CryptoKey, error)
 	Key(label string) (*CryptoKey, error)
-	// @@TODO - not implemented for PKCS11 keyring 9/9/2021
-	//ListKeys() ([]CryptoKey, error)
+	ListKeys(filter *KeyFilter) ([]*CryptoKey, error)
+}
+
+// KeyFilter restricts the keys returned by ListKeys. Only keys whose
+// label starts with LabelPrefix, and which were generated with Algo
+// (if given) are returned. A nil filter matches every key.
+type KeyFilter struct {
+	LabelPrefix string
+	Algo        *KeygenAlgorithm
+}
+
+// Matches returns true if a key with the given label and algorithm
+// passes the filter.
+func (filter *KeyFilter) Matches(label string, algo KeygenAlgorithm) bool {
+	if filter == nil {
+		return true
+	}
+
+	if !strings.HasPrefix(label, filter.LabelPrefix) {
+		return false
+	}
+
+	return filter.Algo == nil || *filter.Algo == algo
 }
 
 // NewKey creates a new ECC key on a Pkcs11 token
 // using the given algorithm from the keygen algos supported. A label
 // can be passed in. This is used as a way of uniquely identifying the key
-// and typically is a large (unguessable) random number
+// and typically is a large (unguessable) random number. ErrKeyExists
+// is returned if a key with the label is already on the token.
 func (ring Pkcs11Keyring) NewKey(algorithm KeygenAlgorithm, label string) (*CryptoKey, error) {
 
+	// The token itself allows several keys with the same label, but
+	// Key could then only return one of them. Keys are created one at
+	// a time, so that no other key can take the label once checked
+	ring.newKeyMtx.Lock()
+	defer ring.newKeyMtx.Unlock()
+
+	_, err := ring.Key(label)
+
+	if err == nil {
+		return nil, ErrKeyExists
+	}
+
+	if err != ErrKeyNotFound {
+		return nil, err
+	}
+
 	// Crypto-secure random bytes
 	id, err := CryptoRandomBytes(16)
 
@@ -61,8 +118,10 @@ func (ring Pkcs11Keyring) NewKey(algorithm KeygenAlgorithm, label string) (*Cryp
 		key, err = ring.ctx.GenerateECDSAKeyPairWithLabel(id, []byte(label), crypto11.P256K1())
 	case KEYGEN_SECP256R1:
 		key, err = ring.ctx.GenerateECDSAKeyPairWithLabel(id, []byte(label), elliptic.P256())
+	case KEYGEN_ED25519:
+		key, err = ring.eddsa.generate(id, []byte(label))
 	default:
-		return nil, err
+		return nil, ErrUnsupportedKey
 	}
 
 	if err != nil {
@@ -72,35 +131,171 @@ func (ring Pkcs11Keyring) NewKey(algorithm KeygenAlgorithm, label string) (*Cryp
 		log.Printf("Key made: %v", key)
 	}
 
-	newkey := CryptoKey{Label: label, Algo: algorithm, signer: key}
-	pubkey := getPubKey(&newkey)
-	newkey.pubk = pubkey
-	
-	return &newkey, nil
+	return newCryptoKey(label, algorithm, key)
 }
 
 // Key retrieves a keypair from the PKCS11 token and populates a
 // CryptoKey object, based on finding the key[air based on the label
 // that is supplied in the API call.
 func (ring Pkcs11Keyring) Key(label string) (*CryptoKey, error) {
-	
+
 	// Note: this API retrieves key PAIRS, so only asymmetric key
 	// algorithms
-	keys, err := ring.ctx.FindKeyPairs(nil, []byte(label))
+	keys, err := ring.ctx.FindKeyPairsWithAttributes(ecdsaAttributes([]byte(label)))
 
 	if err != nil {
 		log.Printf("Key could not be found, with error: %s", err.Error())
 		return nil, err
 	}
 
-	// @@TODO fill out the Algo by retrieving the key type and
-	// thus the curve name - requires some testing though
-	// to determine exactly how
-	newkey := CryptoKey{Label: label, signer: keys[0]}
-	pubkey := getPubKey(&newkey)
-	newkey.pubk = pubkey
+	if len(keys) > 0 {
+		algo, err := ring.ecdsaAlgorithm(keys[0])
+
+		if err != nil {
+			log.Printf("Key %s cannot be used: %s", label, err.Error())
+			return nil, err
+		}
+
+		return newCryptoKey(label, algo, keys[0])
+	}
+
+	// Ed25519 keys are not supported by crypto11, so are looked up
+	// separately, and only if there is no ECDSA key with the label
+	eddsaKeys, err := ring.eddsa.find([]byte(label))
+
+	if err != nil {
+		log.Printf("Key could not be found, with error: %s", err.Error())
+		return nil, err
+	}
+
+	if len(eddsaKeys) == 0 {
+		log.Printf("No key found with label: %s", label)
+		return nil, ErrKeyNotFound
+	}
+
+	return newCryptoKey(label, KEYGEN_ED25519, eddsaKeys[0])
+}
+
+// ecdsaAlgorithm returns the keygen algorithm of an ECDSA key pair
+// on the token, by reading its key type and curve (EC parameters).
+func (ring Pkcs11Keyring) ecdsaAlgorithm(signer crypto11.Signer) (KeygenAlgorithm, error) {
+
+	attrs, err := ring.ctx.GetAttributes(signer, []crypto11.AttributeType{crypto11.CkaKeyType, crypto11.CkaEcParams})
+
+	if err != nil {
+		return 0, err
+	}
+
+	ecKeyType := pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC)
+
+	if attrs[crypto11.CkaKeyType] == nil || !bytes.Equal(attrs[crypto11.CkaKeyType].Value, ecKeyType.Value) {
+		return 0, ErrUnsupportedKey
+	}
+
+	if attrs[crypto11.CkaEcParams] == nil {
+		return 0, ErrUnsupportedKey
+	}
+
+	switch params := attrs[crypto11.CkaEcParams].Value; {
+	case bytes.Equal(params, secp256k1Params):
+		return KEYGEN_SECP256K1, nil
+	case bytes.Equal(params, secp256r1Params):
+		return KEYGEN_SECP256R1, nil
+	default:
+		return 0, ErrUnsupportedKey
+	}
+}
+
+// ecdsaAttributes returns the attributes used to find ECDSA key
+// pairs with crypto11, optionally restricted to a label. The key type
+// must be given, as crypto11 fails a search on finding key types it
+// does not support, such as Ed25519.
+func ecdsaAttributes(label []byte) crypto11.AttributeSet {
+	attributes := crypto11.NewAttributeSet()
+
+	// Set cannot fail for these value types
+	_ = attributes.Set(crypto11.CkaKeyType, pkcs11.CKK_EC)
+
+	if label != nil {
+		_ = attributes.Set(crypto11.CkaLabel, label)
+	}
+
+	return attributes
+}
+
+// ListKeys returns every key pair held on the PKCS11 token which
+// matches the given filter, with its label, algorithm and Cosmos
+// public key filled out. Key pairs whose algorithm is not one of the
+// supported keygen algorithms are skipped.
+func (ring Pkcs11Keyring) ListKeys(filter *KeyFilter) ([]*CryptoKey, error) {
+
+	signers, err := ring.ctx.FindKeyPairsWithAttributes(ecdsaAttributes(nil))
+
+	if err != nil {
+		log.Printf("Keys could not be listed, with error: %s", err.Error())
+		return nil, err
+	}
+
+	// Ed25519 keys are only looked up if the filter allows them
+	var eddsaKeys []*eddsaSigner
 
-	return &newkey, nil
+	if filter == nil || filter.Algo == nil || *filter.Algo == KEYGEN_ED25519 {
+		eddsaKeys, err = ring.eddsa.find(nil)
+
+		if err != nil {
+			log.Printf("Keys could not be listed, with error: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	var list []*CryptoKey
+
+	for _, signer := range signers {
+		attr, err := ring.ctx.GetAttribute(signer, crypto11.CkaLabel)
+
+		if err != nil {
+			log.Printf("Could not read key label: %s", err.Error())
+			return nil, err
+		}
+
+		label := string(attr.Value)
+		algo, err := ring.ecdsaAlgorithm(signer)
+
+		if err != nil {
+			log.Printf("Skipping key %s: %s", label, err.Error())
+			continue
+		}
+
+		if !filter.Matches(label, algo) {
+			continue
+		}
+
+		key, err := newCryptoKey(label, algo, signer)
+
+		if err != nil {
+			log.Printf("Skipping key %s: %s", label, err.Error())
+			continue
+		}
+
+		list = append(list, key)
+	}
+
+	for _, signer := range eddsaKeys {
+		if !filter.Matches(signer.label, KEYGEN_ED25519) {
+			continue
+		}
+
+		key, err := newCryptoKey(signer.label, KEYGEN_ED25519, signer)
+
+		if err != nil {
+			log.Printf("Skipping key %s: %s", signer.label, err.Error())
+			continue
+		}
+
+		list = append(list, key)
+	}
+
+	return list, nil
 }
 
 // NewPkcs11FromConfig returns a new Pkcs11Keyring structure when
@@ -108,7 +303,7 @@ func (ring Pkcs11Keyring) Key(label string) (*CryptoKey, error) {
 // token which holds the actual cryptographic keys.
 func NewPkcs11FromConfig(configPath string) (*Pkcs11Keyring, error) {
 
-	kr := Pkcs11Keyring{}
+	kr := Pkcs11Keyring{newKeyMtx: &sync.Mutex{}}
 	cfg, err := getConfig(configPath)
 
 	if err != nil {
@@ -123,8 +318,18 @@ func NewPkcs11FromConfig(configPath string) (*Pkcs11Keyring, error) {
 		return nil, err
 	}
 
+	// ECDSA keys can still be used on a token whose session for
+	// Ed25519 keys cannot be opened
+	kr.eddsa, err = openEddsaToken(cfg)
+
+	if err != nil {
+		log.Printf("Could not open session for Ed25519 keys, which will be unavailable: %s", err.Error())
+		kr.eddsa = nil
+	}
+
 	kr.ModulePath = cfg.Path
 	kr.TokenLabel = cfg.TokenLabel
+	kr.pin = cfg.Pin
 
 	return &kr, nil
 }
@@ -4,122 +4,302 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"log"
+	"os"
+	"sync"
 	"testing"
 
 	//"github.com/stretchr/testify/assert"
 	btcsecp256k1 "github.com/btcsuite/btcd/btcec"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/ed25519"
 	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256r1"
+	"github.com/miekg/pkcs11"
 	"github.com/stretchr/testify/require"
 
 	sdk "github.com/cosmos/cosmos-sdk/types"
 )
 
-func TestCreateKeySecp256k1(t *testing.T) {
+// testKeyrings returns the keyrings that the keyring tests are run
+// against. An in-memory software keyring is always tested, and a
+// PKCS11 keyring is also tested if a pkcs11-config file is present
+// in the local directory.
+func testKeyrings(t *testing.T) map[string]Keyring {
+	rings := map[string]Keyring{"software": NewInMemoryKeyring()}
 
-	// hardcoded path for now - might change this API to actually
-	// take a JSON string and let caller decide how to get that
-	// JSON
-	kr, err := NewPkcs11FromConfig("./pkcs11-config")
-	require.NoError(t, err)
-	label, err := CryptoRandomBytes(16)
-	require.NoError(t, err)
+	if _, err := os.Stat("./pkcs11-config"); err == nil {
+		// hardcoded path for now - might change this API to actually
+		// take a JSON string and let caller decide how to get that
+		// JSON
+		kr, err := NewPkcs11FromConfig("./pkcs11-config")
+		require.NoError(t, err)
+		rings["pkcs11"] = kr
+	} else {
+		t.Log("No pkcs11-config present, skipping PKCS11 keyring")
+	}
 
-	key, err := kr.NewKey(KEYGEN_SECP256K1, string(label))
-	require.NoError(t, err)
-	require.NotNil(t, key)
+	return rings
+}
 
-	msg := []byte("Signing this plaintext tells me what exactly?")
-	signed, err := key.Sign(msg, nil)
+func TestCreateKeySecp256k1(t *testing.T) {
+	for name, kr := range testKeyrings(t) {
+		kr := kr
+		t.Run(name, func(t *testing.T) {
+			label, err := CryptoRandomBytes(16)
+			require.NoError(t, err)
 
-	require.NoError(t, err)
-	log.Printf("Signed byes: %v", signed)
+			key, err := kr.NewKey(KEYGEN_SECP256K1, string(label))
+			require.NoError(t, err)
+			require.NotNil(t, key)
 
-	pubkey := key.PubKey()
+			msg := []byte("Signing this plaintext tells me what exactly?")
+			signed, err := key.Sign(msg, nil)
 
-	log.Printf("Pubkey: %v", pubkey)
+			require.NoError(t, err)
+			log.Printf("Signed byes: %v", signed)
 
-	require.Equal(t, key.KeyType(), KEYGEN_SECP256K1)
+			pubkey := key.PubKey()
+
+			log.Printf("Pubkey: %v", pubkey)
+
+			require.Equal(t, key.KeyType(), KEYGEN_SECP256K1)
 	
-	if key.KeyType() == KEYGEN_SECP256K1 {
-		secp256k1key := pubkey.(*secp256k1.PubKey)
-		pub, err := btcsecp256k1.ParsePubKey(secp256k1key.Key, btcsecp256k1.S256())
+			if key.KeyType() == KEYGEN_SECP256K1 {
+				secp256k1key := pubkey.(*secp256k1.PubKey)
+				pub, err := btcsecp256k1.ParsePubKey(secp256k1key.Key, btcsecp256k1.S256())
 
-		if err != nil {
-			log.Printf("Not a secp256k1 key?")
-		}
+				if err != nil {
+					log.Printf("Not a secp256k1 key?")
+				}
 		
-		log.Printf("Pub: %v", pub)
+				log.Printf("Pub: %v", pub)
 
-		// Validate the signature made by the HSM key, but using the
-		// BTC secp256k1 public key
-		valid := secp256k1key.VerifySignature(msg, signed)
-		log.Printf("Did the signature verify? True = yes: %v", valid)
+				// Validate the signature made by the HSM key, but using the
+				// BTC secp256k1 public key
+				valid := secp256k1key.VerifySignature(msg, signed)
+				log.Printf("Did the signature verify? True = yes: %v", valid)
 
-		log.Printf("TM blockchain address from pubkey: %v", secp256k1key.Address())
-	}
+				log.Printf("TM blockchain address from pubkey: %v", secp256k1key.Address())
+			}
 	
-	err = key.Delete()
-	require.NoError(t, err)
+			err = key.Delete()
+			require.NoError(t, err)
+		})
+	}
 }
 
 func TestCreateKeySecp256r1(t *testing.T) {
+	for name, kr := range testKeyrings(t) {
+		kr := kr
+		t.Run(name, func(t *testing.T) {
+			label, err := CryptoRandomBytes(16)
+			require.NoError(t, err)
 
-	// hardcoded path for now - might change this API to actually take a JSON string and let caller decide how to get that JSON
-	kr, err := NewPkcs11FromConfig("./pkcs11-config")
-	require.NoError(t, err)
-	label, err := CryptoRandomBytes(16)
-	require.NoError(t, err)
+			key, err := kr.NewKey(KEYGEN_SECP256R1, string(label))
+			require.NoError(t, err)
+			require.NotNil(t, key)
+			require.Equal(t, key.KeyType(), KEYGEN_SECP256R1)
 
-	key, err := kr.NewKey(KEYGEN_SECP256R1, string(label))
-	require.NoError(t, err)
-	require.NotNil(t, key)
-	require.Equal(t, key.KeyType(), KEYGEN_SECP256R1)
+			// Verify that I can also use this key in the X509 universe
+			x509EncodedPub, _ := x509.MarshalPKIXPublicKey(key.Public())
+			pemEncodedPub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: x509EncodedPub})
 
-	// Verify that I can also use this key in the X509 universe
-	x509EncodedPub, _ := x509.MarshalPKIXPublicKey(key.Public())
-	pemEncodedPub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: x509EncodedPub})
+			log.Printf("Public: %s", pemEncodedPub)
 
-	log.Printf("Public: %s", pemEncodedPub)
+			// retrieve the cosmos crypto pubkey, which must be an r1
+			// key for signatures to verify on chain
+			pub := key.PubKey()
+			_, ok := pub.(*secp256r1.PubKey)
+			require.True(t, ok)
 
-	// retrieve the cosmos crypto pubkey
-	pub := key.PubKey()
+			msg := []byte("Signing this plaintext with an r1 key")
+			signed, err := key.Sign(msg, nil)
+			require.NoError(t, err)
+			require.True(t, pub.VerifySignature(msg, signed))
 
-	// Tendermint address
-	log.Printf("AccAddress: %v", sdk.AccAddress( pub.Address()))
+			// Tendermint address
+			log.Printf("AccAddress: %v", sdk.AccAddress( pub.Address()))
 
-	// point a second key object to the same key to test equality
-	key2 := key
+			// point a second key object to the same key to test equality
+			key2 := key
 
-	log.Printf("Keys are equal (should be true)?: %v", key.Equals(*key2))
+			log.Printf("Keys are equal (should be true)?: %v", key.Equals(*key2))
 
-	label2, err := CryptoRandomBytes(16)
-	require.NoError(t, err)
+			label2, err := CryptoRandomBytes(16)
+			require.NoError(t, err)
 
-	// Generate a completely different key
-	key3, err := kr.NewKey( KEYGEN_SECP256R1, string(label2) )
-	require.NoError(t, err)
-	log.Printf("Keys are equal (should be false)?: %v", key.Equals(*key3))
+			// Generate a completely different key
+			key3, err := kr.NewKey( KEYGEN_SECP256R1, string(label2) )
+			require.NoError(t, err)
+			log.Printf("Keys are equal (should be false)?: %v", key.Equals(*key3))
 
-	key4, err := kr.Key( string(label) )
-	require.NoError(t, err)
+			key4, err := kr.Key( string(label) )
+			require.NoError(t, err)
 
-	log.Printf("Keys are equal (should be true)?: %v", key4.Equals(*key))
-	err = key.Delete()
-	require.NoError(t, err)
+			// the algorithm of a reloaded key is recovered from the
+			// keyring, not defaulted to secp256k1
+			require.Equal(t, KEYGEN_SECP256R1, key4.KeyType())
+			_, ok = key4.PubKey().(*secp256r1.PubKey)
+			require.True(t, ok)
+
+			log.Printf("Keys are equal (should be true)?: %v", key4.Equals(*key))
+			err = key.Delete()
+			require.NoError(t, err)
+
+			// This delete should fail since key2 is a pointer to key
+			// which was already deleted
+			err = key2.Delete()
+
+			// Yes, there SHOULD be an error on this delete
+			require.Error(t, err)
+
+			// key3 delete should pass
+			err = key3.Delete()
+			require.NoError(t, err)
+
+			// key4 should again be the same as a key already deleted, so
+			// should fail
+			err = key4.Delete()
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	for name, kr := range testKeyrings(t) {
+		kr := kr
+		t.Run(name, func(t *testing.T) {
+			prefix, err := CryptoRandomBytes(8)
+			require.NoError(t, err)
+
+			key1, err := kr.NewKey(KEYGEN_SECP256K1, string(prefix)+"k1")
+			require.NoError(t, err)
+
+			key2, err := kr.NewKey(KEYGEN_SECP256R1, string(prefix)+"r1")
+			require.NoError(t, err)
 
-	// This delete should fail since key2 is a pointer to key
-	// which was already deleted
-	err = key2.Delete()
+			listed, err := kr.ListKeys(&KeyFilter{LabelPrefix: string(prefix)})
+			require.NoError(t, err)
+			require.Len(t, listed, 2)
 
-	// Yes, there SHOULD be an error on this delete
-	require.Error(t, err)
+			algo := KEYGEN_SECP256R1
+			listed, err = kr.ListKeys(&KeyFilter{LabelPrefix: string(prefix), Algo: &algo})
+			require.NoError(t, err)
+			require.Len(t, listed, 1)
+			require.Equal(t, key2.Label, listed[0].Label)
+			require.Equal(t, KEYGEN_SECP256R1, listed[0].KeyType())
+			require.True(t, listed[0].Equals(*key2))
 
-	// key3 delete should pass
-	err = key3.Delete()
+			all, err := kr.ListKeys(nil)
+			require.NoError(t, err)
+			require.GreaterOrEqual(t, len(all), 2)
+
+			require.NoError(t, key1.Delete())
+			require.NoError(t, key2.Delete())
+		})
+	}
+}
+
+func TestCreateKeyEd25519(t *testing.T) {
+	for name, kr := range testKeyrings(t) {
+		kr := kr
+		t.Run(name, func(t *testing.T) {
+			label, err := CryptoRandomBytes(16)
+			require.NoError(t, err)
+
+			key, err := kr.NewKey(KEYGEN_ED25519, string(label))
+			require.NoError(t, err)
+			require.Equal(t, KEYGEN_ED25519, key.KeyType())
+
+			pubkey, ok := key.PubKey().(*ed25519.PubKey)
+			require.True(t, ok)
+
+			msg := []byte("Signed with EdDSA, without prior hashing")
+			signed, err := key.Sign(msg, nil)
+			require.NoError(t, err)
+			require.True(t, pubkey.VerifySignature(msg, signed))
+
+			// ECDSA profiles cannot be used with an Ed25519 key
+			profile := SIGNING_OPTS_BC_ECDSA_SHA256
+			_, err = key.Sign(msg, &profile)
+			require.Equal(t, ErrUnsupportedProfile, err)
+
+			key2, err := kr.Key(string(label))
+			require.NoError(t, err)
+			require.True(t, key2.Equals(*key))
+			require.Equal(t, KEYGEN_ED25519, key2.KeyType())
+
+			err = key.Delete()
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestCreateKeyDuplicateLabel(t *testing.T) {
+	for name, kr := range testKeyrings(t) {
+		kr := kr
+		t.Run(name, func(t *testing.T) {
+			label, err := CryptoRandomBytes(16)
+			require.NoError(t, err)
+
+			key, err := kr.NewKey(KEYGEN_SECP256K1, string(label))
+			require.NoError(t, err)
+
+			_, err = kr.NewKey(KEYGEN_SECP256R1, string(label))
+			require.Equal(t, ErrKeyExists, err)
+
+			require.NoError(t, key.Delete())
+		})
+	}
+}
+
+func TestCreateKeyConcurrentDuplicateLabel(t *testing.T) {
+	for name, kr := range testKeyrings(t) {
+		kr := kr
+		t.Run(name, func(t *testing.T) {
+			label, err := CryptoRandomBytes(16)
+			require.NoError(t, err)
+
+			const attempts = 8
+			created := make(chan *CryptoKey, attempts)
+			var wg sync.WaitGroup
+
+			for i := 0; i < attempts; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					key, err := kr.NewKey(KEYGEN_SECP256K1, string(label))
+
+					if err == nil {
+						created <- key
+					} else {
+						require.Equal(t, ErrKeyExists, err)
+					}
+				}()
+			}
+
+			wg.Wait()
+			close(created)
+
+			// Only one of the keys is created
+			require.Len(t, created, 1)
+			require.NoError(t, (<-created).Delete())
+		})
+	}
+}
+
+func TestEddsaTokenUnsupported(t *testing.T) {
+	// A token on which no session for Ed25519 keys could be opened
+	var token *eddsaToken
+
+	signers, err := token.find(nil)
 	require.NoError(t, err)
+	require.Empty(t, signers)
+
+	_, err = token.generate([]byte("id"), []byte("label"))
+	require.Equal(t, ErrUnsupportedKey, err)
 
-	// key4 should again be the same as a key already deleted, so
-	// should fail
-	err = key4.Delete()
-	require.Error(t, err)
+	require.True(t, eddsaUnsupported(pkcs11.Error(pkcs11.CKR_ATTRIBUTE_VALUE_INVALID)))
+	require.True(t, eddsaUnsupported(pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)))
+	require.False(t, eddsaUnsupported(pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)))
+	require.False(t, eddsaUnsupported(nil))
 }
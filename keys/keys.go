@@ -8,12 +8,15 @@ import (
 
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/asn1"
 
+	cosmosed25519 "github.com/cosmos/cosmos-sdk/crypto/keys/ed25519"
 	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256r1"
 	"github.com/cosmos/cosmos-sdk/crypto/types"
 	"github.com/frumioj/crypto11"
 )
@@ -44,10 +47,24 @@ const (
 	//  ii) DER signature as in usual ECDSA
 	// iii) No low-s normalization
 	SIGNING_OPTS_ECDSA
+
+	// SIGNING_OPTS_EDDSA means
+	//   i) No hash prior to signing (Ed25519 hashes internally)
+	//  ii) Raw 64 byte Ed25519 signature
+	// This is the only profile for, and the default for, Ed25519 keys
+	SIGNING_OPTS_EDDSA
 )
 
 const PUBLIC_KEY_SIZE = 33
 
+// ErrUnsupportedProfile is returned when a key is asked to sign
+// using a SigningProfile it does not know how to apply.
+var ErrUnsupportedProfile = errors.New("unsupported signing profile")
+
+// ErrUnsupportedKey is returned for keys whose type or curve does not
+// correspond to one of the supported keygen algorithms.
+var ErrUnsupportedKey = errors.New("unsupported key type")
+
 type KeygenAlgorithm int
 type SigningProfile int
 
@@ -84,20 +101,38 @@ func (pk *CryptoKey) Bytes() []byte {
 // concatenated big Ints)
 func (pk *CryptoKey) Sign(plaintext []byte, opts *SigningProfile) ([]byte, error) {
 
-	// @@TODO what if the signing profile doesn't match the type
-	// of the key - shouldn't that make an error?
-	// Who's responsibility is it to make sure key type matches
-	// signing profile
-	
 	var digested []byte
 
+	profile := SIGNING_OPTS_BC_ECDSA_SHA256
+
+	if pk.Algo == KEYGEN_ED25519 {
+		profile = SIGNING_OPTS_EDDSA
+	}
+
+	if opts != nil {
+		profile = *opts
+	}
+
+	// EdDSA signing is only possible with an Ed25519 key, and
+	// Ed25519 keys cannot make ECDSA signatures
+	if (profile == SIGNING_OPTS_EDDSA) != (pk.Algo == KEYGEN_ED25519) {
+		return nil, ErrUnsupportedProfile
+	}
+
+	if profile == SIGNING_OPTS_EDDSA {
+		return pk.signer.Sign(rand.Reader, plaintext, crypto.Hash(0))
+	}
+
 	// Blockchain-flavoured ECDSA (as of 9/2021) means required
 	// sha256 hashing of plaintext prior to signing.
-	if opts == nil || *opts == SIGNING_OPTS_BC_ECDSA_SHA256 {
+	switch profile {
+	case SIGNING_OPTS_BC_ECDSA_SHA256:
 		digest := sha256.Sum256(plaintext)
 		digested = digest[:]
-	} else {
+	case SIGNING_OPTS_ECDSA:
 		digested = plaintext
+	default:
+		return nil, ErrUnsupportedProfile
 	}
 
 	sigbytes, err := pk.signer.Sign(rand.Reader, digested, nil)
@@ -111,7 +146,7 @@ func (pk *CryptoKey) Sign(plaintext []byte, opts *SigningProfile) ([]byte, error
 	// ECDSA (see const definitions above) which means now getting
 	// the raw signature and low-s normalizing the s component of
 	// the signature
-	if opts == nil || *opts == SIGNING_OPTS_BC_ECDSA_SHA256 {
+	if profile != SIGNING_OPTS_ECDSA {
 		// un-DER the sig
 		var rawsig *dsaSignature
 		rawsig, err := unmarshalDER(sigbytes)
@@ -121,7 +156,15 @@ func (pk *CryptoKey) Sign(plaintext []byte, opts *SigningProfile) ([]byte, error
 			return nil, err
 		}
 
-		return signatureRaw(rawsig.R, NormalizeS(rawsig.S, crypto11.P256K1())), nil
+		// Normalize against the order of the curve the key is
+		// actually on, which differs between k1 and r1
+		pub, ok := pk.Public().(*ecdsa.PublicKey)
+
+		if !ok {
+			return nil, ErrUnsupportedKey
+		}
+
+		return signatureRaw(rawsig.R, NormalizeS(rawsig.S, pub.Curve)), nil
 
 	} else {
 		return sigbytes, nil
@@ -153,9 +196,10 @@ func (pk *CryptoKey) Public() crypto.PublicKey { return pk.signer.Public() }
 
 func (pk *CryptoKey) PubKeyBytes() []byte {
 	switch pub := pk.Public().(type) {
+	case ed25519.PublicKey:
+		return []byte(pub)
 	case *ecdsa.PublicKey:
-		// @@TODO: check the curve params for which curve it is first (although outcome is same for both k1 and r1)
-		// is this OK for a *btcec* secp256k1 key?
+		// The compressed point encoding is the same for k1 and r1
 		return elliptic.MarshalCompressed(pub.Curve, pub.X, pub.Y)
 	default:
 		panic("Unsupported public key type!")
@@ -225,13 +269,54 @@ func signatureRaw(r *big.Int, s *big.Int) []byte {
 	return sigBytes
 }
 
-func getPubKey(pk *CryptoKey) types.PubKey {
+// newCryptoKey returns a CryptoKey for the given signer, with its
+// Cosmos public key filled out. An error is returned if the signer's
+// public key is not of a supported type.
+func newCryptoKey(label string, algo KeygenAlgorithm, signer crypto11.Signer) (*CryptoKey, error) {
+	newkey := CryptoKey{Label: label, Algo: algo, signer: signer}
+	pubkey, err := getPubKey(&newkey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	newkey.pubk = pubkey
+
+	return &newkey, nil
+}
+
+func getPubKey(pk *CryptoKey) (types.PubKey, error) {
 	switch pub := pk.Public().(type) {
+	case ed25519.PublicKey:
+		return &cosmosed25519.PubKey{Key: []byte(pub)}, nil
 	case *ecdsa.PublicKey:
-		//@@TODO: check curve params to determine what to do here (result will be the same for r1 and k1)
-		// is this OK for a *btcec* secp256k1 key?
-		return &secp256k1.PubKey{Key: elliptic.MarshalCompressed(pub.Curve, pub.X, pub.Y)}
-	default:
-		panic("Unsupported public key type!")
+		compressed := elliptic.MarshalCompressed(pub.Curve, pub.X, pub.Y)
+
+		// r1 keys have their own Cosmos key type, which gives them
+		// different addresses and signature verification to k1 keys
+		switch pub.Curve.Params().Name {
+		case elliptic.P256().Params().Name:
+			return newSecp256r1PubKey(compressed)
+		case crypto11.P256K1().Params().Name:
+			return &secp256k1.PubKey{Key: compressed}, nil
+		}
+	}
+
+	log.Printf("Unsupported public key type: %T", pk.Public())
+	return nil, ErrUnsupportedKey
+}
+
+// newSecp256r1PubKey returns the Cosmos public key for a compressed
+// P-256 point. The key field of secp256r1.PubKey has an unexported
+// type, so the key is built by unmarshalling its protobuf encoding
+// (field 1, length-delimited).
+func newSecp256r1PubKey(compressed []byte) (*secp256r1.PubKey, error) {
+	bz := append([]byte{0x0a, byte(len(compressed))}, compressed...)
+	pubkey := &secp256r1.PubKey{}
+
+	if err := pubkey.Unmarshal(bz); err != nil {
+		return nil, err
 	}
+
+	return pubkey, nil
 }
@@ -0,0 +1,446 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/frumioj/crypto11"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrKeyExists is returned when creating a key with a label that is
+// already in use in a keyring.
+var ErrKeyExists = errors.New("key with this label already exists")
+
+// ErrDecryptKeyring is returned when a keyring file cannot be
+// decrypted with the given passphrase.
+var ErrDecryptKeyring = errors.New("could not decrypt keyring file")
+
+// scrypt parameters used to derive the keyring file encryption key
+// from its passphrase.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltSize     = 32
+)
+
+// SoftwareKeyring is a Keyring whose keys are generated and used in
+// process memory, rather than on a cryptographic token. It produces
+// CryptoKeys with the same Sign, PubKey and Equals behaviour as the
+// Pkcs11Keyring, so that code using a Keyring can be tested without
+// an HSM. If created with a file path, the keys are also persisted
+// to that file, encrypted with a passphrase.
+//
+// The private key bytes are held in memory, so a SoftwareKeyring
+// must not be used where keys are required to stay within an HSM.
+type SoftwareKeyring struct {
+	mtx        sync.Mutex
+	keys       map[string]*softwareSigner
+	path       string
+	passphrase []byte
+}
+
+// softwareSigner implements crypto11.Signer for a key held in a
+// SoftwareKeyring, so that it may be used as the signer of a
+// CryptoKey.
+type softwareSigner struct {
+	crypto.Signer
+	label string
+	algo  KeygenAlgorithm
+	ring  *SoftwareKeyring
+}
+
+// Delete removes the key from the keyring it belongs to. Deleting a
+// key which has already been deleted results in an error.
+func (s *softwareSigner) Delete() error {
+	return s.ring.delete(s)
+}
+
+// storedKey is the representation of a key in a keyring file.
+type storedKey struct {
+	Label   string          `json:"label"`
+	Algo    KeygenAlgorithm `json:"algo"`
+	Private []byte          `json:"private"`
+}
+
+// keyringFile is the on-disk (encrypted) form of a file keyring.
+type keyringFile struct {
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// NewInMemoryKeyring returns an empty SoftwareKeyring whose keys are
+// lost when the process exits.
+func NewInMemoryKeyring() *SoftwareKeyring {
+	return &SoftwareKeyring{keys: map[string]*softwareSigner{}}
+}
+
+// NewFileKeyring returns a SoftwareKeyring persisted to the file at
+// the given path, encrypted with a key derived from the given
+// passphrase. If the file already exists, the keys it contains are
+// loaded.
+func NewFileKeyring(path string, passphrase string) (*SoftwareKeyring, error) {
+
+	ring := NewInMemoryKeyring()
+	ring.path = path
+	ring.passphrase = []byte(passphrase)
+
+	err := ring.load()
+
+	if err != nil {
+		log.Printf("Could not load keyring file: %s", err.Error())
+		return nil, err
+	}
+
+	return ring, nil
+}
+
+// NewKey generates a new key in process memory using the given
+// algorithm. The label must not already be in use in this keyring.
+func (ring *SoftwareKeyring) NewKey(algorithm KeygenAlgorithm, label string) (*CryptoKey, error) {
+
+	ring.mtx.Lock()
+	defer ring.mtx.Unlock()
+
+	if _, ok := ring.keys[label]; ok {
+		return nil, ErrKeyExists
+	}
+
+	signer, err := generateSigner(algorithm)
+
+	if err != nil {
+		log.Printf("Error generating key: %s", err.Error())
+		return nil, err
+	}
+
+	key := &softwareSigner{Signer: signer, label: label, algo: algorithm, ring: ring}
+	ring.keys[label] = key
+
+	err = ring.save()
+
+	if err != nil {
+		delete(ring.keys, label)
+		return nil, err
+	}
+
+	return newCryptoKey(label, algorithm, key)
+}
+
+// Key returns the key with the given label from the keyring.
+func (ring *SoftwareKeyring) Key(label string) (*CryptoKey, error) {
+
+	ring.mtx.Lock()
+	defer ring.mtx.Unlock()
+
+	key, ok := ring.keys[label]
+
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	return newCryptoKey(key.label, key.algo, key)
+}
+
+// ListKeys returns the keys in the keyring which match the given
+// filter, ordered by label.
+func (ring *SoftwareKeyring) ListKeys(filter *KeyFilter) ([]*CryptoKey, error) {
+
+	ring.mtx.Lock()
+	defer ring.mtx.Unlock()
+
+	var list []*CryptoKey
+
+	for _, key := range ring.keys {
+		if !filter.Matches(key.label, key.algo) {
+			continue
+		}
+
+		cryptoKey, err := newCryptoKey(key.label, key.algo, key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, cryptoKey)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Label < list[j].Label })
+
+	return list, nil
+}
+
+func (ring *SoftwareKeyring) delete(key *softwareSigner) error {
+
+	ring.mtx.Lock()
+	defer ring.mtx.Unlock()
+
+	if ring.keys[key.label] != key {
+		return ErrKeyNotFound
+	}
+
+	delete(ring.keys, key.label)
+
+	err := ring.save()
+
+	if err != nil {
+		ring.keys[key.label] = key
+		return err
+	}
+
+	return nil
+}
+
+// generateSigner generates a new private key in memory using the
+// given keygen algorithm.
+func generateSigner(algorithm KeygenAlgorithm) (crypto.Signer, error) {
+	if algorithm == KEYGEN_ED25519 {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+
+	curve, err := algorithmCurve(algorithm)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ecdsa.GenerateKey(curve, rand.Reader)
+}
+
+// algorithmCurve returns the elliptic curve used by ECDSA keys
+// generated with the given algorithm.
+func algorithmCurve(algorithm KeygenAlgorithm) (elliptic.Curve, error) {
+	switch algorithm {
+	case KEYGEN_SECP256K1:
+		return crypto11.P256K1(), nil
+	case KEYGEN_SECP256R1:
+		return elliptic.P256(), nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// marshalSigner returns the private key bytes of a software key so
+// that it can be stored in a keyring file.
+func marshalSigner(key *softwareSigner) ([]byte, error) {
+	switch priv := key.Signer.(type) {
+	case ed25519.PrivateKey:
+		return priv.Seed(), nil
+	case *ecdsa.PrivateKey:
+		return priv.D.FillBytes(make([]byte, (priv.Curve.Params().BitSize+7)/8)), nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// unmarshalSigner recreates a private key from the bytes stored in a
+// keyring file.
+func unmarshalSigner(algorithm KeygenAlgorithm, private []byte) (crypto.Signer, error) {
+	if algorithm == KEYGEN_ED25519 {
+		if len(private) != ed25519.SeedSize {
+			return nil, ErrUnsupportedKey
+		}
+
+		return ed25519.NewKeyFromSeed(private), nil
+	}
+
+	curve, err := algorithmCurve(algorithm)
+
+	if err != nil {
+		return nil, err
+	}
+
+	priv := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(private)}
+	priv.PublicKey.Curve = curve
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(private)
+
+	return priv, nil
+}
+
+// save encrypts and writes the keyring to its file, if it has one.
+// The caller must hold the keyring lock.
+func (ring *SoftwareKeyring) save() error {
+
+	if len(ring.path) == 0 {
+		return nil
+	}
+
+	stored := []storedKey{}
+
+	for _, key := range ring.keys {
+		private, err := marshalSigner(key)
+
+		if err != nil {
+			return err
+		}
+
+		stored = append(stored, storedKey{Label: key.label, Algo: key.algo, Private: private})
+	}
+
+	plaintext, err := json.Marshal(stored)
+
+	if err != nil {
+		return err
+	}
+
+	file, err := encryptKeyring(plaintext, ring.passphrase)
+
+	if err != nil {
+		log.Printf("Could not encrypt keyring: %s", err.Error())
+		return err
+	}
+
+	contents, err := json.Marshal(file)
+
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a failed write cannot
+	// leave a truncated keyring behind
+	tmp, err := ioutil.TempFile(filepath.Dir(ring.path), filepath.Base(ring.path)+".tmp")
+
+	if err != nil {
+		log.Printf("Could not write keyring file: %s", err.Error())
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), ring.path)
+}
+
+// load reads and decrypts the keyring file, if it exists.
+func (ring *SoftwareKeyring) load() error {
+
+	contents, err := ioutil.ReadFile(ring.path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var file keyringFile
+
+	if err = json.Unmarshal(contents, &file); err != nil {
+		return err
+	}
+
+	plaintext, err := decryptKeyring(&file, ring.passphrase)
+
+	if err != nil {
+		return err
+	}
+
+	var stored []storedKey
+
+	if err = json.Unmarshal(plaintext, &stored); err != nil {
+		return err
+	}
+
+	for _, s := range stored {
+		signer, err := unmarshalSigner(s.Algo, s.Private)
+
+		if err != nil {
+			return err
+		}
+
+		ring.keys[s.Label] = &softwareSigner{Signer: signer, label: s.Label, algo: s.Algo, ring: ring}
+	}
+
+	return nil
+}
+
+// encryptKeyring encrypts the plaintext with AES-GCM, using a key
+// derived from the passphrase with scrypt and a fresh random salt.
+func encryptKeyring(plaintext []byte, passphrase []byte) (*keyringFile, error) {
+
+	salt, err := CryptoRandomBytes(saltSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := keyringCipher(passphrase, salt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return &keyringFile{Salt: salt, Nonce: nonce, Ciphertext: aead.Seal(nil, nonce, plaintext, nil)}, nil
+}
+
+// decryptKeyring reverses encryptKeyring.
+func decryptKeyring(file *keyringFile, passphrase []byte) ([]byte, error) {
+
+	aead, err := keyringCipher(passphrase, file.Salt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(file.Nonce) != aead.NonceSize() {
+		return nil, ErrDecryptKeyring
+	}
+
+	plaintext, err := aead.Open(nil, file.Nonce, file.Ciphertext, nil)
+
+	if err != nil {
+		return nil, ErrDecryptKeyring
+	}
+
+	return plaintext, nil
+}
+
+func keyringCipher(passphrase []byte, salt []byte) (cipher.AEAD, error) {
+
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,49 @@
+package keys
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileKeyringPersistence(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "keyring")
+
+	kr, err := NewFileKeyring(path, "correct horse battery staple")
+	require.NoError(t, err)
+
+	key, err := kr.NewKey(KEYGEN_SECP256K1, "persisted")
+	require.NoError(t, err)
+
+	_, err = kr.NewKey(KEYGEN_SECP256R1, "persisted")
+	require.Equal(t, ErrKeyExists, err)
+
+	// Reopening the file should give back the same key
+	reopened, err := NewFileKeyring(path, "correct horse battery staple")
+	require.NoError(t, err)
+
+	key2, err := reopened.Key("persisted")
+	require.NoError(t, err)
+	require.True(t, key2.Equals(*key))
+	require.Equal(t, KEYGEN_SECP256K1, key2.KeyType())
+
+	msg := []byte("Signed by a key loaded from a file")
+	signed, err := key2.Sign(msg, nil)
+	require.NoError(t, err)
+	require.True(t, key.PubKey().VerifySignature(msg, signed))
+
+	// The wrong passphrase must not open the keyring
+	_, err = NewFileKeyring(path, "wrong")
+	require.Equal(t, ErrDecryptKeyring, err)
+
+	// Deletes are persisted too
+	require.NoError(t, key2.Delete())
+
+	reopened, err = NewFileKeyring(path, "correct horse battery staple")
+	require.NoError(t, err)
+
+	_, err = reopened.Key("persisted")
+	require.Equal(t, ErrKeyNotFound, err)
+}
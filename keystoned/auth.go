@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	codectypes "github.com/cosmos/cosmos-sdk/codec/types"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/ed25519"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256r1"
+	cryptotypes "github.com/cosmos/cosmos-sdk/crypto/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+
+	keystonepb "github.com/regen-network/keystone/keystoned/proto"
+)
+
+// AUTH_METADATA_KEY is the gRPC metadata key under which callers send
+// the signed envelope (keystonepb.RequestAuth) authenticating each
+// request. The -bin suffix tells gRPC that the value is binary.
+const AUTH_METADATA_KEY = "x-keystone-auth-bin"
+
+// AUTH_MAX_CLOCK_SKEW is the default for how far the timestamp of a
+// request envelope may be from the server clock.
+const AUTH_MAX_CLOCK_SKEW = 5 * time.Minute
+
+// MIN_NONCE_LEN is the minimum length, in bytes, of the nonce of a
+// request envelope or device-signed sign request.
+const MIN_NONCE_LEN = 16
+
+// ENVELOPE_NONCE_PREFIX is prefixed to the device address to give the
+// scope in which the nonces of request envelopes are recorded.
+const ENVELOPE_NONCE_PREFIX = "envelope/"
+
+// SIGN_NONCE_PREFIX is prefixed to the key label to give the scope in
+// which the nonces of sign requests for the key are recorded, whichever
+// of the user's devices sends them.
+const SIGN_NONCE_PREFIX = "key/"
+
+// KEYRING_SERVICE_PREFIX is the prefix of the full method names of the
+// keyring service (proto/keystone2.proto), which may only be called
+// by clients presenting a certificate trusted by the server.
+const KEYRING_SERVICE_PREFIX = "/keystone.keyring/"
+
+// caller is the authenticated caller of a Keystone service request:
+// the device key which signed the request envelope.
+type caller struct {
+	PubKey  cryptotypes.PubKey
+	Address sdk.AccAddress
+}
+
+type callerKey struct{}
+
+// callerFromContext returns the authenticated caller of a request, if
+// there is one.
+func callerFromContext(ctx context.Context) (*caller, bool) {
+	c, ok := ctx.Value(callerKey{}).(*caller)
+	return c, ok
+}
+
+// listenerTLSConfig describes how the Keystone gRPC listener is
+// secured. If no certificate is given, the listener is unencrypted.
+// ClientCAFile, if given, is used to verify client certificates, which
+// callers of the keyring service must present (mutual TLS).
+type listenerTLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// serverCredentials returns the gRPC server option for the listener
+// TLS configuration, or nil if TLS is not configured.
+func (cfg listenerTLSConfig) serverCredentials() (grpc.ServerOption, error) {
+
+	if len(cfg.CertFile) == 0 && len(cfg.KeyFile) == 0 {
+		if len(cfg.ClientCAFile) > 0 {
+			return nil, errors.New("a server certificate and key are needed to verify client certificates")
+		}
+
+		return nil, nil
+	}
+
+	if len(cfg.CertFile) == 0 || len(cfg.KeyFile) == 0 {
+		return nil, errors.New("both a server certificate and key must be given")
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if len(cfg.ClientCAFile) > 0 {
+		pem, err := ioutil.ReadFile(cfg.ClientCAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA bundle %s", cfg.ClientCAFile)
+		}
+
+		// Devices authenticate with signed request envelopes, so only
+		// callers of the keyring service need a client certificate
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return grpc.Creds(credentials.NewTLS(tlsConfig)), nil
+}
+
+// authInterceptor authenticates every unary request to the Keystone
+// services. Keystone service requests must carry an envelope signed
+// by the caller's device key, over the method, a timestamp, a nonce
+// and the request itself, and an envelope is only accepted once. The
+// verified caller is added to the request context for the service
+// methods to authorize. Keyring service requests must come from a
+// client with a verified TLS certificate.
+type authInterceptor struct {
+	MaxClockSkew time.Duration
+	Nonces       nonceStore
+}
+
+func (a *authInterceptor) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+	if strings.HasPrefix(info.FullMethod, KEYRING_SERVICE_PREFIX) {
+		if !verifiedClientCert(ctx) {
+			log.Printf("Rejected %s: no verified client certificate", info.FullMethod)
+			return nil, status.Error(codes.Unauthenticated, "a verified client certificate is required")
+		}
+
+		return handler(ctx, req)
+	}
+
+	msg, ok := req.(proto.Message)
+
+	if !ok {
+		return nil, status.Error(codes.Internal, "request is not a protobuf message")
+	}
+
+	c, err := a.authenticate(ctx, info.FullMethod, msg)
+
+	if err != nil {
+		log.Printf("Rejected %s: %s", info.FullMethod, err.Error())
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	return handler(context.WithValue(ctx, callerKey{}, c), req)
+}
+
+// recoverPanics is a unary interceptor which turns a panic in a
+// request handler (or a later interceptor) into an internal error,
+// so that one bad request cannot stop the server.
+func recoverPanics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic handling %s: %v\n%s", info.FullMethod, r, debug.Stack())
+			err = status.Error(codes.Internal, "internal error")
+		}
+	}()
+
+	return handler(ctx, req)
+}
+
+// authenticate verifies the signed envelope sent with a request, and
+// returns the caller whose device key signed it.
+func (a *authInterceptor) authenticate(ctx context.Context, method string, req proto.Message) (*caller, error) {
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(AUTH_METADATA_KEY)
+
+	if len(values) != 1 {
+		return nil, errors.New("request must carry exactly one signed envelope")
+	}
+
+	var auth keystonepb.RequestAuth
+
+	err := proto.Unmarshal([]byte(values[0]), &auth)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope: %s", err.Error())
+	}
+
+	if auth.PublicKey == nil || len(auth.Signature) == 0 {
+		return nil, errors.New("envelope must have a public key and signature")
+	}
+
+	if len(auth.Nonce) < MIN_NONCE_LEN {
+		return nil, fmt.Errorf("envelope nonce must be at least %d bytes", MIN_NONCE_LEN)
+	}
+
+	signBytes, err := authSignBytes(method, auth.Timestamp, auth.Nonce, req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, err := verifyDeviceSignature(auth.PublicKey, auth.Timestamp, a.MaxClockSkew, signBytes, auth.Signature)
+
+	if err != nil {
+		return nil, fmt.Errorf("envelope: %s", err.Error())
+	}
+
+	address := sdk.AccAddress(pubKey.Address())
+
+	// Envelope nonces are kept apart from those of sign requests, so
+	// that a device may use the same nonce for both
+	err = a.Nonces.Use(ENVELOPE_NONCE_PREFIX+address.String(), auth.Nonce, time.Unix(auth.Timestamp, 0).Add(a.MaxClockSkew))
+
+	if err != nil {
+		return nil, fmt.Errorf("envelope: %s", err.Error())
+	}
+
+	return &caller{PubKey: pubKey, Address: address}, nil
+}
+
+// verifyDeviceSignature checks that a device signature over the given
+// bytes was made by the given public key (a Cosmos SDK public key,
+// such as a secp256k1 or secp256r1 key) at a time within the allowed
+// clock skew. The device public key is returned. Only secp256k1,
+// secp256r1 and ed25519 public keys are supported.
+func verifyDeviceSignature(publicKey *anypb.Any, timestamp int64, maxSkew time.Duration, signBytes []byte, signature []byte) (cryptotypes.PubKey, error) {
+
+	skew := time.Since(time.Unix(timestamp, 0))
+
+	if skew > maxSkew || skew < -maxSkew {
+		return nil, fmt.Errorf("timestamp %d is outside the allowed clock skew", timestamp)
+	}
+
+	var pubKey cryptotypes.PubKey
+
+	err := makeEncodingConfig().InterfaceRegistry.UnpackAny(&codectypes.Any{TypeUrl: publicKey.TypeUrl, Value: publicKey.Value}, &pubKey)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %s", err.Error())
+	}
+
+	// Only single keys are accepted: others, such as multisig keys,
+	// cannot verify a signature (and may panic if asked to)
+	switch pubKey.(type) {
+	case *secp256k1.PubKey, *secp256r1.PubKey, *ed25519.PubKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key type: %s", publicKey.TypeUrl)
+	}
+
+	if !pubKey.VerifySignature(signBytes, signature) {
+		return nil, errors.New("signature does not verify")
+	}
+
+	return pubKey, nil
+}
+
+// authSignBytes returns the bytes signed by a caller in a request
+// envelope: the encoding of the method, timestamp, nonce and request.
+func authSignBytes(method string, timestamp int64, nonce []byte, req proto.Message) ([]byte, error) {
+
+	request, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.MarshalOptions{Deterministic: true}.Marshal(&keystonepb.RequestAuthSignDoc{
+		Method:    method,
+		Timestamp: timestamp,
+		Request:   request,
+		Nonce:     nonce,
+	})
+}
+
+// verifiedClientCert returns true if the caller presented a client
+// certificate which the server verified.
+func verifiedClientCert(ctx context.Context) bool {
+
+	p, ok := peer.FromContext(ctx)
+
+	if !ok {
+		return false
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+
+	return ok && len(tlsInfo.State.VerifiedChains) > 0
+}
+
+// authorizeAccount checks that the caller of a request is a member of
+// the group of the given group account, on whose behalf the request
+// acts. Accounts which are not group accounts (such as the Keystone
+// server address) cannot be acted for by callers.
+func (s *server) authorizeAccount(ctx context.Context, account string) error {
+
+	if !s.RequireAuth {
+		return nil
+	}
+
+	groupID, err := groupAccountGroup(s.ChainConn, account)
+
+	if err != nil {
+		return fmt.Errorf("%s is not a group account: %s", account, err.Error())
+	}
+
+	return s.authorizeMember(ctx, groupID)
+}
+
+// authorizeProposal checks that the caller of a request is a member
+// of the group to which the given proposal was made.
+func (s *server) authorizeProposal(ctx context.Context, proposalID uint64) error {
+
+	if !s.RequireAuth {
+		return nil
+	}
+
+	proposal, err := queryProposal(s.ChainConn, proposalID)
+
+	if err != nil {
+		return fmt.Errorf("proposal %d not found: %s", proposalID, err.Error())
+	}
+
+	return s.authorizeAccount(ctx, proposal.Address)
+}
+
+// authorizeMember checks that the caller of a request is a member of
+// the given group.
+func (s *server) authorizeMember(ctx context.Context, groupID uint64) error {
+
+	c, ok := callerFromContext(ctx)
+
+	if !ok {
+		return errors.New("request is not authenticated")
+	}
+
+	member, err := s.isGroupMember(groupID, c.Address.String())
+
+	if err != nil {
+		return err
+	}
+
+	if !member {
+		return fmt.Errorf("%s is not a member of group %d", c.Address.String(), groupID)
+	}
+
+	return nil
+}
+
+// isGroupMember returns true if the given address is a member of the
+// given group.
+func (s *server) isGroupMember(groupID uint64, address string) (bool, error) {
+
+	members, err := groupMembers(s.ChainConn, groupID)
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, m := range members {
+		if m.Address == address {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// authorizeDevice checks that a device may use the key of the given
+// registration: it must be the device which registered the user, or
+// a member of the user's key group.
+func (s *server) authorizeDevice(reg *keystonepb.Registration, device string) error {
+
+	if device == reg.DeviceAddress {
+		return nil
+	}
+
+	member, err := s.isGroupMember(reg.KeyGroupId, device)
+
+	if err != nil {
+		return err
+	}
+
+	if !member {
+		return fmt.Errorf("device %s is not a member of key group %d", device, reg.KeyGroupId)
+	}
+
+	return nil
+}
+
+// authorizeAddress checks that the caller of a request is the holder
+// of the key with the given address.
+func (s *server) authorizeAddress(ctx context.Context, address string) error {
+
+	if !s.RequireAuth {
+		return nil
+	}
+
+	c, ok := callerFromContext(ctx)
+
+	if !ok {
+		return errors.New("request is not authenticated")
+	}
+
+	if c.Address.String() != address {
+		return fmt.Errorf("request for %s was signed by %s", address, c.Address.String())
+	}
+
+	return nil
+}
+
+// verifySignRequest checks the device proof of a sign request: that
+// the device signature over the request, its nonce and timestamp
+// verifies, and that the nonce has not been used for the requested key
+// before. If requests are authenticated, the device must also be the
+// caller. The device public key is returned.
+func (s *server) verifySignRequest(ctx context.Context, in *keystonepb.SignRequest) (cryptotypes.PubKey, error) {
+
+	if in.DevicePublicKey == nil || len(in.DeviceSignature) == 0 {
+		return nil, errors.New("request has no device public key or signature")
+	}
+
+	if len(in.Nonce) < MIN_NONCE_LEN {
+		return nil, fmt.Errorf("nonce must be at least %d bytes", MIN_NONCE_LEN)
+	}
+
+	signBytes, err := proto.MarshalOptions{Deterministic: true}.Marshal(&keystonepb.SignRequestSignDoc{
+		ForSigning: in.ForSigning,
+		KeyLabel:   in.KeyLabel,
+		Nonce:      in.Nonce,
+		Timestamp:  in.Timestamp,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, err := verifyDeviceSignature(in.DevicePublicKey, in.Timestamp, s.MaxClockSkew, signBytes, in.DeviceSignature)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.RequireAuth {
+		c, ok := callerFromContext(ctx)
+
+		if !ok || !c.PubKey.Equals(pubKey) {
+			return nil, errors.New("request was not sent by the signing device")
+		}
+	}
+
+	// Once its timestamp is too old to be accepted, a request cannot
+	// be replayed, so its nonce only needs to be kept until then
+	expiry := time.Unix(in.Timestamp, 0).Add(s.MaxClockSkew)
+	err = s.Nonces.Use(SIGN_NONCE_PREFIX+in.KeyLabel, in.Nonce, expiry)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pubKey, nil
+}
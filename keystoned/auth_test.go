@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	codectypes "github.com/cosmos/cosmos-sdk/codec/types"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/multisig"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	cryptotypes "github.com/cosmos/cosmos-sdk/crypto/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+
+	keystonepb "github.com/regen-network/keystone/keystoned/proto"
+)
+
+const (
+	testKeystoneMethod = "/register.keystoneService/Register"
+	testKeyringMethod  = KEYRING_SERVICE_PREFIX + "sign"
+)
+
+func anyPubKey(t *testing.T, pubKey cryptotypes.PubKey) *anypb.Any {
+	a, err := codectypes.NewAnyWithValue(pubKey)
+	require.NoError(t, err)
+
+	return &anypb.Any{TypeUrl: a.TypeUrl, Value: a.Value}
+}
+
+// envelopeContext returns an incoming request context carrying an
+// envelope for the request, signed by the given device key.
+func envelopeContext(t *testing.T, device *secp256k1.PrivKey, method string, timestamp int64, nonce []byte, req proto.Message) context.Context {
+	signBytes, err := authSignBytes(method, timestamp, nonce, req)
+	require.NoError(t, err)
+
+	signature, err := device.Sign(signBytes)
+	require.NoError(t, err)
+
+	auth, err := proto.Marshal(&keystonepb.RequestAuth{
+		PublicKey: anyPubKey(t, device.PubKey()),
+		Timestamp: timestamp,
+		Signature: signature,
+		Nonce:     nonce,
+	})
+	require.NoError(t, err)
+
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(AUTH_METADATA_KEY, string(auth)))
+}
+
+func testNonce(b byte) []byte {
+	nonce := make([]byte, MIN_NONCE_LEN)
+	nonce[0] = b
+
+	return nonce
+}
+
+func TestVerifyDeviceSignature(t *testing.T) {
+	device := secp256k1.GenPrivKey()
+	msg := []byte("request")
+	now := time.Now().Unix()
+
+	signature, err := device.Sign(msg)
+	require.NoError(t, err)
+
+	pubKey, err := verifyDeviceSignature(anyPubKey(t, device.PubKey()), now, time.Minute, msg, signature)
+	require.NoError(t, err)
+	require.True(t, pubKey.Equals(device.PubKey()))
+
+	// A signature over other bytes, or by another key, is rejected
+	_, err = verifyDeviceSignature(anyPubKey(t, device.PubKey()), now, time.Minute, []byte("other"), signature)
+	require.Error(t, err)
+
+	_, err = verifyDeviceSignature(anyPubKey(t, secp256k1.GenPrivKey().PubKey()), now, time.Minute, msg, signature)
+	require.Error(t, err)
+
+	// Timestamps too far in the past or future are rejected
+	_, err = verifyDeviceSignature(anyPubKey(t, device.PubKey()), now-120, time.Minute, msg, signature)
+	require.Error(t, err)
+
+	_, err = verifyDeviceSignature(anyPubKey(t, device.PubKey()), now+120, time.Minute, msg, signature)
+	require.Error(t, err)
+}
+
+func TestVerifyDeviceSignatureUnsupportedKey(t *testing.T) {
+	device := secp256k1.GenPrivKey()
+	msg := []byte("request")
+
+	signature, err := device.Sign(msg)
+	require.NoError(t, err)
+
+	// Multisig keys panic if asked to verify a signature
+	multisigKey := multisig.NewLegacyAminoPubKey(1, []cryptotypes.PubKey{device.PubKey()})
+
+	require.NotPanics(t, func() {
+		_, err = verifyDeviceSignature(anyPubKey(t, multisigKey), time.Now().Unix(), time.Minute, msg, signature)
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unsupported public key type")
+
+	_, err = verifyDeviceSignature(&anypb.Any{TypeUrl: "/unknown.PubKey"}, time.Now().Unix(), time.Minute, msg, signature)
+	require.Error(t, err)
+}
+
+func TestAuthInterceptorKeystoneService(t *testing.T) {
+	a := &authInterceptor{MaxClockSkew: time.Minute, Nonces: &dbNonceStore{db: dbm.NewMemDB()}}
+	device := secp256k1.GenPrivKey()
+	req := &keystonepb.RegisterRequest{Address: "regen1user"}
+	info := &grpc.UnaryServerInfo{FullMethod: testKeystoneMethod}
+
+	var called *caller
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called, _ = callerFromContext(ctx)
+		return "ok", nil
+	}
+
+	// No envelope
+	_, err := a.unary(context.Background(), req, info, handler)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.Nil(t, called)
+
+	ctx := envelopeContext(t, device, testKeystoneMethod, time.Now().Unix(), testNonce(1), req)
+
+	res, err := a.unary(ctx, req, info, handler)
+	require.NoError(t, err)
+	require.Equal(t, "ok", res)
+	require.NotNil(t, called)
+	require.Equal(t, sdk.AccAddress(device.PubKey().Address()), called.Address)
+
+	// The same envelope cannot be replayed
+	called = nil
+	_, err = a.unary(ctx, req, info, handler)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.Nil(t, called)
+
+	// An envelope for another request or method is rejected
+	ctx = envelopeContext(t, device, testKeystoneMethod, time.Now().Unix(), testNonce(2), &keystonepb.RegisterRequest{Address: "regen1other"})
+	_, err = a.unary(ctx, req, info, handler)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx = envelopeContext(t, device, "/register.keystoneService/Sign", time.Now().Unix(), testNonce(3), req)
+	_, err = a.unary(ctx, req, info, handler)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// A short nonce is rejected
+	ctx = envelopeContext(t, device, testKeystoneMethod, time.Now().Unix(), []byte("short"), req)
+	_, err = a.unary(ctx, req, info, handler)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// A client certificate does not authenticate a Keystone service
+	// request
+	_, err = a.unary(verifiedCertContext(), req, info, handler)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestAuthInterceptorKeyringService(t *testing.T) {
+	a := &authInterceptor{MaxClockSkew: time.Minute, Nonces: &dbNonceStore{db: dbm.NewMemDB()}}
+	req := &keystonepb.KeySpec{Label: "label"}
+	info := &grpc.UnaryServerInfo{FullMethod: testKeyringMethod}
+	called := false
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return "ok", nil
+	}
+
+	// A device envelope does not authenticate a keyring request
+	ctx := envelopeContext(t, secp256k1.GenPrivKey(), testKeyringMethod, time.Now().Unix(), testNonce(1), req)
+	_, err := a.unary(ctx, req, info, handler)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.False(t, called)
+
+	_, err = a.unary(verifiedCertContext(), req, info, handler)
+	require.NoError(t, err)
+	require.True(t, called)
+}
+
+func TestRecoverPanics(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: testKeystoneMethod}
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("not implemented")
+	}
+
+	_, err := recoverPanics(context.Background(), nil, info, handler)
+	require.Equal(t, codes.Internal, status.Code(err))
+}
+
+// verifiedCertContext returns an incoming request context from a
+// client whose TLS certificate was verified.
+func verifiedCertContext() context.Context {
+	state := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{&x509.Certificate{}}}}
+
+	return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+}
+
+// signedSignRequest returns a sign request with a device proof by the
+// given device key.
+func signedSignRequest(t *testing.T, device *secp256k1.PrivKey, label string, nonce []byte, timestamp int64) *keystonepb.SignRequest {
+	signBytes, err := proto.MarshalOptions{Deterministic: true}.Marshal(&keystonepb.SignRequestSignDoc{
+		ForSigning: []byte("sign me"),
+		KeyLabel:   label,
+		Nonce:      nonce,
+		Timestamp:  timestamp,
+	})
+	require.NoError(t, err)
+
+	signature, err := device.Sign(signBytes)
+	require.NoError(t, err)
+
+	return &keystonepb.SignRequest{
+		ForSigning:      []byte("sign me"),
+		KeyLabel:        label,
+		DevicePublicKey: anyPubKey(t, device.PubKey()),
+		Nonce:           nonce,
+		Timestamp:       timestamp,
+		DeviceSignature: signature,
+	}
+}
+
+// callerContext returns a request context whose envelope was signed
+// by the given device key.
+func callerContext(device *secp256k1.PrivKey) context.Context {
+	pubKey := device.PubKey()
+	return context.WithValue(context.Background(), callerKey{}, &caller{PubKey: pubKey, Address: sdk.AccAddress(pubKey.Address())})
+}
+
+func TestVerifySignRequest(t *testing.T) {
+	s := &server{MaxClockSkew: time.Minute, Nonces: &dbNonceStore{db: dbm.NewMemDB()}}
+	device := secp256k1.GenPrivKey()
+	now := time.Now().Unix()
+
+	in := signedSignRequest(t, device, "user", testNonce(1), now)
+
+	pubKey, err := s.verifySignRequest(context.Background(), in)
+	require.NoError(t, err)
+	require.True(t, pubKey.Equals(device.PubKey()))
+
+	// The proof covers every field of the sign doc
+	tampered := []func(in *keystonepb.SignRequest){
+		func(in *keystonepb.SignRequest) { in.ForSigning = []byte("sign this instead") },
+		func(in *keystonepb.SignRequest) { in.KeyLabel = "other" },
+		func(in *keystonepb.SignRequest) { in.Nonce = testNonce(99) },
+		func(in *keystonepb.SignRequest) { in.Timestamp = now - 1 },
+		func(in *keystonepb.SignRequest) { in.DevicePublicKey = anyPubKey(t, secp256k1.GenPrivKey().PubKey()) },
+	}
+
+	for i, tamper := range tampered {
+		in := signedSignRequest(t, device, "user", testNonce(byte(10+i)), now)
+		tamper(in)
+
+		_, err = s.verifySignRequest(context.Background(), in)
+		require.Error(t, err, "tampered field %d", i)
+	}
+
+	// A proof is required, with a long enough nonce
+	_, err = s.verifySignRequest(context.Background(), &keystonepb.SignRequest{ForSigning: []byte("sign me"), KeyLabel: "user"})
+	require.Error(t, err)
+
+	_, err = s.verifySignRequest(context.Background(), signedSignRequest(t, device, "user", []byte("short"), now))
+	require.Error(t, err)
+
+	_, err = s.verifySignRequest(context.Background(), signedSignRequest(t, device, "user", testNonce(2), now-120))
+	require.Error(t, err)
+}
+
+func TestVerifySignRequestReplay(t *testing.T) {
+	s := &server{MaxClockSkew: time.Minute, Nonces: &dbNonceStore{db: dbm.NewMemDB()}}
+	device := secp256k1.GenPrivKey()
+	in := signedSignRequest(t, device, "user", testNonce(1), time.Now().Unix())
+
+	_, err := s.verifySignRequest(context.Background(), in)
+	require.NoError(t, err)
+
+	_, err = s.verifySignRequest(context.Background(), in)
+	require.Equal(t, errNonceUsed, err)
+
+	// A new nonce makes a new request
+	_, err = s.verifySignRequest(context.Background(), signedSignRequest(t, device, "user", testNonce(2), time.Now().Unix()))
+	require.NoError(t, err)
+
+	// Nonces are recorded per user key, whichever device uses them
+	_, err = s.verifySignRequest(context.Background(), signedSignRequest(t, secp256k1.GenPrivKey(), "user", testNonce(1), time.Now().Unix()))
+	require.Equal(t, errNonceUsed, err)
+
+	_, err = s.verifySignRequest(context.Background(), signedSignRequest(t, device, "other", testNonce(1), time.Now().Unix()))
+	require.NoError(t, err)
+}
+
+func TestVerifySignRequestDeviceMismatch(t *testing.T) {
+	s := &server{RequireAuth: true, MaxClockSkew: time.Minute, Nonces: &dbNonceStore{db: dbm.NewMemDB()}}
+	device := secp256k1.GenPrivKey()
+	now := time.Now().Unix()
+
+	// The request must be sent by the device which signed the proof
+	_, err := s.verifySignRequest(context.Background(), signedSignRequest(t, device, "user", testNonce(1), now))
+	require.Error(t, err)
+
+	_, err = s.verifySignRequest(callerContext(secp256k1.GenPrivKey()), signedSignRequest(t, device, "user", testNonce(2), now))
+	require.Error(t, err)
+
+	_, err = s.verifySignRequest(callerContext(device), signedSignRequest(t, device, "user", testNonce(3), now))
+	require.NoError(t, err)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// chainTLSConfig describes how the connection to the gRPC endpoint of
+// a chain node is secured. If TLS is not enabled, the connection is
+// unencrypted. CAFile, if given, replaces the system roots used to
+// verify the node certificate, and CertFile and KeyFile, if given, are
+// presented to the node as a client certificate.
+type chainTLSConfig struct {
+	Enabled  bool
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// dialChain opens a connection to the gRPC endpoint of a chain node at
+// the given address. The connection is shared by every transaction
+// and query that keystoned sends, so it should be opened once, and
+// closed when the server exits.
+func dialChain(address string, cfg chainTLSConfig) (*grpc.ClientConn, error) {
+
+	if !cfg.Enabled {
+		log.Printf("Connecting to chain gRPC endpoint %s without TLS", address)
+		return grpc.Dial(address, grpc.WithInsecure())
+	}
+
+	tlsConfig, err := cfg.tlsConfig()
+
+	if err != nil {
+		log.Printf("Error configuring chain TLS: %s", err.Error())
+		return nil, err
+	}
+
+	return grpc.Dial(address, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+}
+
+// tlsConfig builds the client TLS configuration from the CA bundle
+// and client certificate files.
+func (cfg chainTLSConfig) tlsConfig() (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if len(cfg.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(cfg.CertFile) > 0 || len(cfg.KeyFile) > 0 {
+		if len(cfg.CertFile) == 0 || len(cfg.KeyFile) == 0 {
+			return nil, errors.New("both a client certificate and key must be given")
+		}
+
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cosmos/cosmos-sdk/codec/legacy"
+	"github.com/cosmos/cosmos-sdk/crypto"
+	"github.com/cosmos/cosmos-sdk/crypto/hd"
+	"github.com/cosmos/cosmos-sdk/crypto/keyring"
+	"github.com/cosmos/cosmos-sdk/crypto/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+
+	"github.com/regen-network/keystone/keys"
+)
+
+// KEYRING_PASSPHRASE_ENV is the environment variable holding the
+// passphrase for the Cosmos file keyring backend.
+const KEYRING_PASSPHRASE_ENV = "KEYSTONE_KEYRING_PASSPHRASE"
+
+// BACKEND_PKCS11 is the keyring backend, in addition to those of the
+// Cosmos SDK, whose keys are held on a PKCS11 token.
+const BACKEND_PKCS11 = "pkcs11"
+
+// errKeyNotExportable is returned for keyring operations which would
+// move private key material into or out of a PKCS11 token.
+var errKeyNotExportable = errors.New("operation not supported: keys cannot be imported to or exported from the token")
+
+// openCosmosKeyring returns the Cosmos SDK keyring of the given
+// backend type: one of the Cosmos SDK backends (os, file, test or
+// memory), or pkcs11. The pkcs11 backend uses the Keystone keystore if
+// that is itself a PKCS11 token, and otherwise opens the token given
+// in the PKCS11 configuration file.
+func openCosmosKeyring(backend string, dir string, keystore keys.Keyring, pkcs11Config string) (keyring.Keyring, error) {
+	switch backend {
+	case BACKEND_PKCS11:
+		if ring, ok := keystore.(*keys.Pkcs11Keyring); ok {
+			return &pkcs11CosmosKeyring{ring: ring}, nil
+		}
+
+		ring, err := keys.NewPkcs11FromConfig(pkcs11Config)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &pkcs11CosmosKeyring{ring: ring}, nil
+	case keyring.BackendFile:
+		passphrase, ok := os.LookupEnv(KEYRING_PASSPHRASE_ENV)
+
+		if !ok {
+			return nil, fmt.Errorf("%s must be set for the file keyring backend", KEYRING_PASSPHRASE_ENV)
+		}
+
+		// The file backend may ask for the passphrase (and, when the
+		// keyring is new, for it to be re-entered) more than once
+		return keyring.New(sdk.KeyringServiceName(), backend, dir, &passphraseReader{line: []byte(passphrase + "\n")})
+	case keyring.BackendOS, keyring.BackendTest, keyring.BackendMemory:
+		if backend == keyring.BackendTest || backend == keyring.BackendMemory {
+			log.Printf("Using the %s keyring backend: not for production use", backend)
+		}
+
+		return keyring.New(sdk.KeyringServiceName(), backend, dir, os.Stdin)
+	default:
+		return nil, fmt.Errorf("unknown keyring backend: %s", backend)
+	}
+}
+
+// passphraseReader supplies the same passphrase line each time the
+// Cosmos SDK keyring prompts for it.
+type passphraseReader struct {
+	line []byte
+	off  int
+}
+
+func (r *passphraseReader) Read(p []byte) (int, error) {
+	n := 0
+
+	for n < len(p) {
+		copied := copy(p[n:], r.line[r.off:])
+		n += copied
+		r.off = (r.off + copied) % len(r.line)
+	}
+
+	return n, nil
+}
+
+// pkcs11CosmosKeyring implements the Cosmos SDK keyring.Keyring
+// interface with the keys on a PKCS11 token, so that Cosmos SDK
+// client code can sign with them. Only the operations which keep the
+// private keys on the token are supported. The token is used through
+// the keys.Keyring interface, which the tests satisfy with a software
+// keyring.
+type pkcs11CosmosKeyring struct {
+	ring keys.Keyring
+}
+
+var _ keyring.Keyring = &pkcs11CosmosKeyring{}
+
+// pkcs11Info is the keyring.Info for a key on a PKCS11 token.
+type pkcs11Info struct {
+	name   string
+	pubKey types.PubKey
+	algo   hd.PubKeyType
+}
+
+func newPkcs11Info(key *keys.CryptoKey) keyring.Info {
+	var algo hd.PubKeyType
+
+	switch key.Algo {
+	case keys.KEYGEN_SECP256K1:
+		algo = hd.Secp256k1Type
+	case keys.KEYGEN_ED25519:
+		algo = hd.Ed25519Type
+	default:
+		algo = hd.PubKeyType(key.PubKey().Type())
+	}
+
+	return &pkcs11Info{name: key.Label, pubKey: key.PubKey(), algo: algo}
+}
+
+// Keys on the token can sign, so are reported as local keys
+func (i pkcs11Info) GetType() keyring.KeyType   { return keyring.TypeLocal }
+func (i pkcs11Info) GetName() string            { return i.name }
+func (i pkcs11Info) GetPubKey() types.PubKey    { return i.pubKey }
+func (i pkcs11Info) GetAddress() sdk.AccAddress { return i.pubKey.Address().Bytes() }
+func (i pkcs11Info) GetAlgo() hd.PubKeyType     { return i.algo }
+func (i pkcs11Info) GetPath() (*hd.BIP44Params, error) {
+	return nil, fmt.Errorf("BIP44 Paths are not available for this type")
+}
+
+func (k *pkcs11CosmosKeyring) List() ([]keyring.Info, error) {
+	list, err := k.ring.ListKeys(nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]keyring.Info, 0, len(list))
+
+	for _, key := range list {
+		infos = append(infos, newPkcs11Info(key))
+	}
+
+	return infos, nil
+}
+
+func (k *pkcs11CosmosKeyring) SupportedAlgorithms() (keyring.SigningAlgoList, keyring.SigningAlgoList) {
+	return keyring.SigningAlgoList{hd.Secp256k1}, keyring.SigningAlgoList{}
+}
+
+func (k *pkcs11CosmosKeyring) Key(uid string) (keyring.Info, error) {
+	key, err := k.key(uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newPkcs11Info(key), nil
+}
+
+func (k *pkcs11CosmosKeyring) KeyByAddress(address sdk.Address) (keyring.Info, error) {
+	key, err := k.keyByAddress(address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newPkcs11Info(key), nil
+}
+
+func (k *pkcs11CosmosKeyring) Delete(uid string) error {
+	key, err := k.key(uid)
+
+	if err != nil {
+		return err
+	}
+
+	return key.Delete()
+}
+
+func (k *pkcs11CosmosKeyring) DeleteByAddress(address sdk.Address) error {
+	key, err := k.keyByAddress(address)
+
+	if err != nil {
+		return err
+	}
+
+	return key.Delete()
+}
+
+// Keys derived from a mnemonic would have to be created outside of
+// the token, so are not supported
+func (k *pkcs11CosmosKeyring) NewMnemonic(uid string, language keyring.Language, hdPath, bip39Passphrase string, algo keyring.SignatureAlgo) (keyring.Info, string, error) {
+	return nil, "", errKeyNotExportable
+}
+
+func (k *pkcs11CosmosKeyring) NewAccount(uid, mnemonic, bip39Passphrase, hdPath string, algo keyring.SignatureAlgo) (keyring.Info, error) {
+	return nil, errKeyNotExportable
+}
+
+func (k *pkcs11CosmosKeyring) SaveLedgerKey(uid string, algo keyring.SignatureAlgo, hrp string, coinType, account, index uint32) (keyring.Info, error) {
+	return nil, errKeyNotExportable
+}
+
+func (k *pkcs11CosmosKeyring) SavePubKey(uid string, pubkey types.PubKey, algo hd.PubKeyType) (keyring.Info, error) {
+	return nil, errKeyNotExportable
+}
+
+func (k *pkcs11CosmosKeyring) SaveMultisig(uid string, pubkey types.PubKey) (keyring.Info, error) {
+	return nil, errKeyNotExportable
+}
+
+// Sign signs the message on the token, with the default signing
+// profile of the key, which is the one expected by Cosmos chains.
+func (k *pkcs11CosmosKeyring) Sign(uid string, msg []byte) ([]byte, types.PubKey, error) {
+	key, err := k.key(uid)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signature, err := key.Sign(msg, nil)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return signature, key.PubKey(), nil
+}
+
+func (k *pkcs11CosmosKeyring) SignByAddress(address sdk.Address, msg []byte) ([]byte, types.PubKey, error) {
+	key, err := k.keyByAddress(address)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return k.Sign(key.Label, msg)
+}
+
+func (k *pkcs11CosmosKeyring) ImportPrivKey(uid, armor, passphrase string) error {
+	return errKeyNotExportable
+}
+
+func (k *pkcs11CosmosKeyring) ImportPubKey(uid string, armor string) error {
+	return errKeyNotExportable
+}
+
+func (k *pkcs11CosmosKeyring) ExportPubKeyArmor(uid string) (string, error) {
+	info, err := k.Key(uid)
+
+	if err != nil {
+		return "", err
+	}
+
+	return crypto.ArmorPubKeyBytes(legacy.Cdc.MustMarshal(info.GetPubKey()), string(info.GetAlgo())), nil
+}
+
+func (k *pkcs11CosmosKeyring) ExportPubKeyArmorByAddress(address sdk.Address) (string, error) {
+	info, err := k.KeyByAddress(address)
+
+	if err != nil {
+		return "", err
+	}
+
+	return k.ExportPubKeyArmor(info.GetName())
+}
+
+func (k *pkcs11CosmosKeyring) ExportPrivKeyArmor(uid, encryptPassphrase string) (string, error) {
+	return "", errKeyNotExportable
+}
+
+func (k *pkcs11CosmosKeyring) ExportPrivKeyArmorByAddress(address sdk.Address, encryptPassphrase string) (string, error) {
+	return "", errKeyNotExportable
+}
+
+// key returns the key on the token with the given label, with the
+// Cosmos SDK keyring error if there is none.
+func (k *pkcs11CosmosKeyring) key(uid string) (*keys.CryptoKey, error) {
+	key, err := k.ring.Key(uid)
+
+	if err == keys.ErrKeyNotFound {
+		return nil, sdkerrors.Wrap(sdkerrors.ErrKeyNotFound, uid)
+	}
+
+	return key, err
+}
+
+// keyByAddress returns the key on the token whose public key has the
+// given address.
+func (k *pkcs11CosmosKeyring) keyByAddress(address sdk.Address) (*keys.CryptoKey, error) {
+	list, err := k.ring.ListKeys(nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range list {
+		if keyAddress(key).Equals(address) {
+			return key, nil
+		}
+	}
+
+	return nil, sdkerrors.Wrap(sdkerrors.ErrKeyNotFound, address.String())
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/cosmos-sdk/crypto/hd"
+	"github.com/cosmos/cosmos-sdk/crypto/keyring"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+
+	"github.com/regen-network/keystone/keys"
+)
+
+func TestOpenCosmosKeyringPkcs11(t *testing.T) {
+	keystore := keys.NewInMemoryKeyring()
+
+	// The Keystone keystore is used if it is a PKCS11 token; any other
+	// keystore is not, and the token is opened from its configuration
+	_, err := openCosmosKeyring(BACKEND_PKCS11, t.TempDir(), keystore, "./no-such-pkcs11-config")
+	require.Error(t, err)
+
+	_, err = openCosmosKeyring("ledger", t.TempDir(), keystore, "")
+	require.Error(t, err)
+
+	kr, err := openCosmosKeyring(keyring.BackendMemory, t.TempDir(), keystore, "")
+	require.NoError(t, err)
+	require.NotNil(t, kr)
+}
+
+func TestPkcs11CosmosKeyring(t *testing.T) {
+	keystore := keys.NewInMemoryKeyring()
+	key, err := keystore.NewKey(keys.KEYGEN_SECP256K1, "user")
+	require.NoError(t, err)
+
+	kr := &pkcs11CosmosKeyring{ring: keystore}
+
+	info, err := kr.Key("user")
+	require.NoError(t, err)
+	require.Equal(t, "user", info.GetName())
+	require.Equal(t, keyring.TypeLocal, info.GetType())
+	require.Equal(t, hd.Secp256k1Type, info.GetAlgo())
+	require.True(t, key.PubKey().Equals(info.GetPubKey()))
+	require.Equal(t, keyAddress(key), info.GetAddress())
+
+	info, err = kr.KeyByAddress(keyAddress(key))
+	require.NoError(t, err)
+	require.Equal(t, "user", info.GetName())
+
+	list, err := kr.List()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+
+	// Signatures are made with the default (chain) signing profile
+	msg := []byte("sign me")
+	sig, pub, err := kr.Sign("user", msg)
+	require.NoError(t, err)
+	require.True(t, pub.VerifySignature(msg, sig))
+
+	sig, _, err = kr.SignByAddress(keyAddress(key), msg)
+	require.NoError(t, err)
+	require.True(t, key.PubKey().VerifySignature(msg, sig))
+
+	_, err = kr.Key("other")
+	require.ErrorIs(t, err, sdkerrors.ErrKeyNotFound)
+
+	// Private keys cannot leave the token, or be brought into it
+	_, err = kr.ExportPrivKeyArmor("user", "passphrase")
+	require.Equal(t, errKeyNotExportable, err)
+
+	_, _, err = kr.NewMnemonic("new", keyring.English, "", "", hd.Secp256k1)
+	require.Equal(t, errKeyNotExportable, err)
+
+	armor, err := kr.ExportPubKeyArmor("user")
+	require.NoError(t, err)
+	require.NotEmpty(t, armor)
+
+	require.NoError(t, kr.Delete("user"))
+	_, err = kr.Key("user")
+	require.ErrorIs(t, err, sdkerrors.ErrKeyNotFound)
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/cosmos/cosmos-sdk/x/auth/tx"
 	grptypes "github.com/regen-network/regen-ledger/x/group"
 	authtypes "github.com/cosmos/cosmos-sdk/x/auth/types"
+	banktypes "github.com/cosmos/cosmos-sdk/x/bank/types"
 	cryptotypes "github.com/cosmos/cosmos-sdk/crypto/codec"
 )
 
@@ -21,6 +22,7 @@ func makeEncodingConfig() params.EncodingConfig {
 	txCfg := tx.NewTxConfig(marshaler, tx.DefaultSignModes)
 
 	authtypes.RegisterInterfaces(interfaceRegistry)
+	banktypes.RegisterInterfaces(interfaceRegistry)
 	cryptotypes.RegisterInterfaces(interfaceRegistry)
 	grptypes.RegisterTypes(interfaceRegistry)
 
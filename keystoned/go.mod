@@ -12,12 +12,18 @@ replace github.com/regen-network/regen-ledger/types => github.com/regen-network/
 
 require (
 	github.com/ThalesIgnite/crypto11 v1.2.4 // indirect
-	github.com/cosmos/cosmos-sdk v0.43.0-rc0
-	github.com/regen-network/keystone/keystoned/keys v0.0.0-20210823173722-5de519e0203f
+	github.com/cosmos/cosmos-sdk v0.43.0
+	github.com/gogo/protobuf v1.3.3
+	github.com/regen-network/keystone/keys v0.0.0-00010101000000-000000000000
 	github.com/regen-network/regen-ledger/x/group v0.0.0-20210804173213-3265a868bf83
+	github.com/stretchr/testify v1.7.0
+	github.com/tendermint/tendermint v0.34.12
+	github.com/tendermint/tm-db v0.6.4
 	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985 // indirect
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
 	google.golang.org/genproto v0.0.0-20210804223703-f1db76f3300d // indirect
 	google.golang.org/grpc v1.40.0
 	google.golang.org/protobuf v1.27.1
 )
+
+replace github.com/regen-network/keystone/keys => ../keys
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/types/query"
+	"github.com/regen-network/regen-ledger/x/group"
+	"google.golang.org/grpc"
+
+	"github.com/regen-network/keystone/keys"
+)
+
+// Default threshold decision policies for the group accounts of the
+// groups created by Register. Either member of the admin group (the
+// user or the Keystone servers) may change a user's groups, while both
+// members of the key group must approve its transactions.
+const (
+	ADMIN_GROUP_THRESHOLD = "1"
+	KEY_GROUP_THRESHOLD   = "2"
+	GROUP_POLICY_TIMEOUT  = 24 * time.Hour
+)
+
+// thresholdPolicy is a threshold decision policy for a group account:
+// a proposal passes once the weight of its yes votes reaches the
+// threshold, within the timeout.
+type thresholdPolicy struct {
+	Threshold string
+	Timeout   time.Duration
+}
+
+// validate checks that the threshold is a positive decimal, and no
+// more than the given total weight of the group members (if that is
+// known, i.e. not nil), and that the timeout is positive.
+func (p thresholdPolicy) validate(totalWeight *sdk.Dec) error {
+
+	threshold, err := sdk.NewDecFromStr(p.Threshold)
+
+	if err != nil {
+		return fmt.Errorf("invalid threshold %q: %s", p.Threshold, err.Error())
+	}
+
+	if !threshold.IsPositive() {
+		return fmt.Errorf("threshold must be positive: %s", p.Threshold)
+	}
+
+	if totalWeight != nil && threshold.GT(*totalWeight) {
+		return fmt.Errorf("threshold %s is more than the total member weight %s", p.Threshold, totalWeight.String())
+	}
+
+	if p.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive: %s", p.Timeout)
+	}
+
+	return nil
+}
+
+// decisionPolicy returns the group module decision policy.
+func (p thresholdPolicy) decisionPolicy() group.DecisionPolicy {
+	return group.NewThresholdDecisionPolicy(p.Threshold, p.Timeout)
+}
+
+// totalWeight returns the sum of the weights of the given members.
+func totalWeight(members []group.Member) (sdk.Dec, error) {
+
+	total := sdk.ZeroDec()
+
+	for _, m := range members {
+		weight, err := sdk.NewDecFromStr(m.Weight)
+
+		if err != nil {
+			return total, err
+		}
+
+		total = total.Add(weight)
+	}
+
+	return total, nil
+}
+
+//adminMembers returns a []group.Member with two members
+func adminMembers( addr1 string, addr2 string ) []group.Member{
+
+	member1 := group.Member{
+		Address:  addr1,
+		Weight:   strconv.Itoa(1),
+	}
+
+	member2 := group.Member{
+		Address:  addr2,
+		Weight:   strconv.Itoa(1),
+	}
+
+	return []group.Member{member1, member2}
+}
+
+// deviceMember returns the group member for a user's device, with the
+// same weight as the members given by adminMembers.
+func deviceMember(address string, metadata []byte) group.Member {
+	return group.Member{
+		Address:  address,
+		Weight:   strconv.Itoa(1),
+		Metadata: metadata,
+	}
+}
+
+// createAdminGroup creates the admin group for a user, with the given
+// members and metadata, and a group account for it with the given
+// decision policy so that the group has an address with which it can
+// administer other groups. The group ID and group account address are
+// returned.
+func createAdminGroup(signer *keys.CryptoKey, memberList []group.Member, metadata []byte, policy thresholdPolicy, chain *chainClient) (uint64, string, error) {
+
+	groupID, err := createGroup(signer, memberList, metadata, chain)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	address, err := createGroupAccount(signer, groupID, policy, chain)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	return groupID, address, nil
+}
+
+// createKeyGroup creates the key group for a user, with the given
+// members and metadata, and a group account for it with the given
+// decision policy, which is used to sign on the user's behalf. Both
+// are then handed over to the admin group, along with the admin group
+// itself, so that the Keystone server key is no longer their
+// administrator. The key group ID and group account address are
+// returned.
+func createKeyGroup(signer *keys.CryptoKey, memberList []group.Member, metadata []byte, policy thresholdPolicy, adminGroupID uint64, adminAddress string, chain *chainClient) (uint64, string, error) {
+
+	groupID, err := createGroup(signer, memberList, metadata, chain)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	address, err := createGroupAccount(signer, groupID, policy, chain)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = updateAdmins(signer, []uint64{adminGroupID, groupID}, []string{adminAddress, address}, adminAddress, chain)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	return groupID, address, nil
+}
+
+// CreateGroup creates a Cosmos Group using the MsgCreateGroup, filling
+// the message with the input fields. The group admin, and signer of
+// the transaction, is the given Keystone key, so the transaction is
+// signed inside the keystore rather than by a Cosmos SDK keyring. The
+// ID of the new group is returned.
+func createGroup(signer *keys.CryptoKey, memberList []group.Member, metadata []byte, chain *chainClient) (uint64, error) {
+
+	msg := &group.MsgCreateGroup{
+		Admin:    keyAddress(signer).String(),
+		Members:  memberList,
+		Metadata: metadata,
+	}
+
+	res, err := chain.sendTx(&txRequest{Signer: signer, Msgs: []sdk.Msg{msg}})
+
+	if err != nil {
+		log.Printf("Error creating group: %s", err.Error())
+		return 0, err
+	}
+
+	var created group.MsgCreateGroupResponse
+
+	err = msgResult(res, 0, &created)
+
+	if err != nil || created.GroupId == 0 {
+		// The ID is also given by the group creation event
+		for _, event := range msgEvents(res, 0) {
+			if e, ok := event.(*group.EventCreateGroup); ok {
+				created.GroupId = e.GroupId
+			}
+		}
+	}
+
+	if created.GroupId == 0 {
+		return 0, fmt.Errorf("no group ID found in result of transaction %s", res.TxHash)
+	}
+
+	log.Printf("Group created: %d", created.GroupId)
+
+	return created.GroupId, nil
+}
+
+// createGroupAccount creates a group account for the given group,
+// administered by the given Keystone key, with the given threshold
+// decision policy. The address of the new group account is returned.
+func createGroupAccount(signer *keys.CryptoKey, groupID uint64, policy thresholdPolicy, chain *chainClient) (string, error) {
+
+	msg, err := group.NewMsgCreateGroupAccountRequest(keyAddress(signer), groupID, nil, policy.decisionPolicy())
+
+	if err != nil {
+		log.Printf("Error building group account message: %s", err.Error())
+		return "", err
+	}
+
+	res, err := chain.sendTx(&txRequest{Signer: signer, Msgs: []sdk.Msg{msg}})
+
+	if err != nil {
+		log.Printf("Error creating group account: %s", err.Error())
+		return "", err
+	}
+
+	var created group.MsgCreateGroupAccountResponse
+
+	err = msgResult(res, 0, &created)
+
+	if err != nil || len(created.Address) == 0 {
+		// The address is also given by the group account creation
+		// event
+		for _, event := range msgEvents(res, 0) {
+			if e, ok := event.(*group.EventCreateGroupAccount); ok {
+				created.Address = e.Address
+			}
+		}
+	}
+
+	if len(created.Address) == 0 {
+		return "", fmt.Errorf("no address found for group account of group %d in transaction %s", groupID, res.TxHash)
+	}
+
+	log.Printf("Group account created: %s", created.Address)
+
+	return created.Address, nil
+}
+
+// updateAdmins makes newAdmin the administrator of the given groups
+// and group accounts, which must currently be administered by the
+// given Keystone key. All of the updates are made in one transaction.
+func updateAdmins(signer *keys.CryptoKey, groupIDs []uint64, accounts []string, newAdmin string, chain *chainClient) error {
+
+	admin := keyAddress(signer).String()
+	msgs := []sdk.Msg{}
+
+	for _, groupID := range groupIDs {
+		msgs = append(msgs, &group.MsgUpdateGroupAdmin{
+			Admin:    admin,
+			GroupId:  groupID,
+			NewAdmin: newAdmin,
+		})
+	}
+
+	for _, account := range accounts {
+		msgs = append(msgs, &group.MsgUpdateGroupAccountAdmin{
+			Admin:    admin,
+			Address:  account,
+			NewAdmin: newAdmin,
+		})
+	}
+
+	_, err := chain.sendTx(&txRequest{Signer: signer, Msgs: msgs})
+
+	if err != nil {
+		log.Printf("Error updating group admins: %s", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// execAsAdmin executes the given message, which must have the given
+// admin as its only signer. If the admin is the Keystone key itself,
+// the message is sent directly. Otherwise the admin must be a group
+// account of a group which the Keystone key is a member of, and the
+// message is proposed to that group, to be executed straight away if
+// the Keystone key's vote is enough to pass it. The ID of the
+// proposal (0 if none was needed) and whether the message has been
+// executed are returned.
+func execAsAdmin(signer *keys.CryptoKey, admin string, msg sdk.Msg, chain *chainClient) (uint64, bool, error) {
+
+	signerAddr := keyAddress(signer).String()
+
+	if admin == signerAddr {
+		_, err := chain.sendTx(&txRequest{Signer: signer, Msgs: []sdk.Msg{msg}})
+
+		if err != nil {
+			return 0, false, err
+		}
+
+		return 0, true, nil
+	}
+
+	proposal, err := group.NewMsgCreateProposalRequest(admin, []string{signerAddr}, []sdk.Msg{msg}, nil, group.Exec_EXEC_TRY)
+
+	if err != nil {
+		log.Printf("Error building proposal: %s", err.Error())
+		return 0, false, err
+	}
+
+	res, err := chain.sendTx(&txRequest{Signer: signer, Msgs: []sdk.Msg{proposal}})
+
+	if err != nil {
+		log.Printf("Error creating proposal: %s", err.Error())
+		return 0, false, err
+	}
+
+	var created group.MsgCreateProposalResponse
+
+	err = msgResult(res, 0, &created)
+
+	if err != nil {
+		log.Printf("Error decoding proposal creation result: %s", err.Error())
+		return 0, false, err
+	}
+
+	executed := proposalExecuted(res, 0, created.ProposalId)
+
+	log.Printf("Proposal %d to %s, executed: %v", created.ProposalId, admin, executed)
+
+	return created.ProposalId, executed, nil
+}
+
+// proposalExecuted returns true if the message at the given index in
+// a transaction executed the given proposal, which is shown by it
+// emitting an exec event.
+func proposalExecuted(res *sdk.TxResponse, index int, proposalID uint64) bool {
+
+	for _, event := range msgEvents(res, index) {
+		if e, ok := event.(*group.EventExec); ok && e.ProposalId == proposalID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// groupMembers returns the members of the given group from the chain.
+func groupMembers(grpcConn *grpc.ClientConn, groupID uint64) ([]group.Member, error) {
+
+	queryClient := group.NewQueryClient(grpcConn)
+	members := []group.Member{}
+	var nextKey []byte
+
+	for {
+		res, err := queryClient.GroupMembers(context.Background(), &group.QueryGroupMembersRequest{
+			GroupId:    groupID,
+			Pagination: &query.PageRequest{Key: nextKey},
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range res.Members {
+			if m.Member != nil {
+				members = append(members, *m.Member)
+			}
+		}
+
+		if res.Pagination == nil || len(res.Pagination.NextKey) == 0 {
+			return members, nil
+		}
+
+		nextKey = res.Pagination.NextKey
+	}
+}
+
+// groupAccountGroup returns the ID of the group of the given group
+// account from the chain.
+func groupAccountGroup(grpcConn *grpc.ClientConn, address string) (uint64, error) {
+
+	res, err := group.NewQueryClient(grpcConn).GroupAccountInfo(context.Background(), &group.QueryGroupAccountInfoRequest{Address: address})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.Info.GroupId, nil
+}
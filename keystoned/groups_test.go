@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/regen-network/regen-ledger/x/group"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThresholdPolicyValidate(t *testing.T) {
+	total := sdk.NewDec(2)
+
+	require.NoError(t, thresholdPolicy{Threshold: "1", Timeout: time.Hour}.validate(&total))
+	require.NoError(t, thresholdPolicy{Threshold: "2", Timeout: time.Hour}.validate(&total))
+
+	// Without a total weight, any positive threshold is valid
+	require.NoError(t, thresholdPolicy{Threshold: "100", Timeout: time.Hour}.validate(nil))
+
+	require.Error(t, thresholdPolicy{Threshold: "one", Timeout: time.Hour}.validate(&total))
+	require.Error(t, thresholdPolicy{Threshold: "", Timeout: time.Hour}.validate(&total))
+	require.Error(t, thresholdPolicy{Threshold: "0", Timeout: time.Hour}.validate(&total))
+	require.Error(t, thresholdPolicy{Threshold: "-1", Timeout: time.Hour}.validate(&total))
+	require.Error(t, thresholdPolicy{Threshold: "2.5", Timeout: time.Hour}.validate(&total))
+	require.Error(t, thresholdPolicy{Threshold: "1", Timeout: 0}.validate(&total))
+	require.Error(t, thresholdPolicy{Threshold: "1", Timeout: -time.Second}.validate(&total))
+}
+
+func TestTotalWeight(t *testing.T) {
+	total, err := totalWeight(nil)
+	require.NoError(t, err)
+	require.True(t, total.IsZero())
+
+	total, err = totalWeight([]group.Member{{Weight: "1"}, {Weight: "2.5"}})
+	require.NoError(t, err)
+	require.True(t, total.Equal(sdk.MustNewDecFromStr("3.5")))
+
+	_, err = totalWeight([]group.Member{{Weight: "1"}, {Weight: "heavy"}})
+	require.Error(t, err)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/regen-network/keystone/keys"
+	keystonepb "github.com/regen-network/keystone/keystoned/proto"
+)
+
+// KEYSTORE_PASSPHRASE_ENV is the environment variable holding the
+// passphrase for the file keystore.
+const KEYSTORE_PASSPHRASE_ENV = "KEYSTONE_KEYSTORE_PASSPHRASE"
+
+// openKeystore returns the keys.Keyring holding Keystone keys, of the
+// given keystore type.
+func openKeystore(keystoreType string, pkcs11Config string, keystoreFile string) (keys.Keyring, error) {
+	switch keystoreType {
+	case "pkcs11":
+		return keys.NewPkcs11FromConfig(pkcs11Config)
+	case "file":
+		passphrase, ok := os.LookupEnv(KEYSTORE_PASSPHRASE_ENV)
+
+		if !ok {
+			return nil, fmt.Errorf("%s must be set for the file keystore", KEYSTORE_PASSPHRASE_ENV)
+		}
+
+		return keys.NewFileKeyring(keystoreFile, passphrase)
+	case "memory":
+		log.Println("Using in-memory keystore: keys will be lost on exit")
+		return keys.NewInMemoryKeyring(), nil
+	default:
+		return nil, fmt.Errorf("unknown keystore type: %s", keystoreType)
+	}
+}
+
+// keyringServer implements the keyring service given in the protobuf
+// definition (proto/keystone2.proto), backed by a keys.Keyring so
+// that remote callers can use keys held in the HSM without linking
+// the keys package directly. The Keystone server key and the keys of
+// users cannot be used to sign through this service: they
+// may only sign for Keystone transactions, or for sign requests
+// proven to come from a user's device.
+type keyringServer struct {
+	keystonepb.UnimplementedKeyringServer
+	Keyring        keys.Keyring
+	ServerKeyLabel string
+	Registry       userRegistry
+}
+
+// NewKey generates a new key in the keyring using the algorithm and
+// label in the given key spec. If no label is given, a random one is
+// generated and returned in the key reference.
+func (k *keyringServer) NewKey(ctx context.Context, in *keystonepb.KeySpec) (*keystonepb.KeyRef, error) {
+	label := in.Label
+
+	// The labels of user keys are derived from their devices, so
+	// cannot be taken by other keys
+	if strings.HasPrefix(label, USER_KEY_LABEL_PREFIX) {
+		return nil, fmt.Errorf("labels starting with %s are reserved for user keys", USER_KEY_LABEL_PREFIX)
+	}
+
+	if len(label) == 0 {
+		random, err := keys.CryptoRandomBytes(16)
+
+		if err != nil {
+			return nil, err
+		}
+
+		label = hex.EncodeToString(random)
+	}
+
+	key, err := k.Keyring.NewKey(keys.KeygenAlgorithm(in.Algo), label)
+
+	if err != nil {
+		log.Printf("Error creating key: %s", err.Error())
+		return nil, err
+	}
+
+	return &keystonepb.KeyRef{Label: &key.Label}, nil
+}
+
+// Key looks up the key with the label in the given key spec. The
+// returned key reference has no label if no such key exists.
+func (k *keyringServer) Key(ctx context.Context, in *keystonepb.KeySpec) (*keystonepb.KeyRef, error) {
+	key, err := k.Keyring.Key(in.Label)
+
+	if errors.Is(err, keys.ErrKeyNotFound) {
+		return &keystonepb.KeyRef{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &keystonepb.KeyRef{Label: &key.Label}, nil
+}
+
+// Pubkey returns the Cosmos public key bytes of the key with the
+// label in the given key spec.
+func (k *keyringServer) Pubkey(ctx context.Context, in *keystonepb.KeySpec) (*keystonepb.PublicKey, error) {
+	key, err := k.Keyring.Key(in.Label)
+
+	if err != nil {
+		log.Printf("Error retrieving public key: %s", err.Error())
+		return nil, err
+	}
+
+	return &keystonepb.PublicKey{Label: key.Label, KeyBytes: key.PubKey().Bytes()}, nil
+}
+
+// Sign signs the content of the given message with the key named in
+// its key spec, using the requested signing profile. The Keystone
+// server key and users' keys are refused. Failures to find
+// the key or to sign are returned as a status code in the error field
+// of the response.
+func (k *keyringServer) Sign(ctx context.Context, in *keystonepb.Msg) (*keystonepb.Signed, error) {
+	signable := in.Content.GetSignableBytes()
+
+	if in.KeySpec == nil || len(signable) == 0 {
+		log.Println("Sign request missing key spec or bytes for signing")
+		return signedError(STATUS_BAD_REQUEST), nil
+	}
+
+	err := k.checkSignable(in.KeySpec.Label)
+
+	if err != nil {
+		log.Printf("Refused keyring sign request: %s", err.Error())
+		return signedError(STATUS_UNAUTHORIZED), nil
+	}
+
+	plaintext, profile, err := signingProfile(in.SigningProfile, signable)
+
+	if err != nil {
+		log.Printf("Error applying signing profile: %s", err.Error())
+		return signedError(STATUS_BAD_REQUEST), nil
+	}
+
+	key, err := k.Keyring.Key(in.KeySpec.Label)
+
+	if err != nil {
+		log.Printf("Error retrieving key for signing: %s", err.Error())
+		return signedError(STATUS_KEY_NOT_FOUND), nil
+	}
+
+	signed, err := key.Sign(plaintext, &profile)
+
+	if err != nil {
+		log.Printf("Error signing: %s", err.Error())
+		return signedError(STATUS_SIGNING_FAILED), nil
+	}
+
+	return &keystonepb.Signed{SignedUnion: &keystonepb.Signed_SignedBytes{SignedBytes: signed}}, nil
+}
+
+// checkSignable checks that the key with the given label may be used
+// to sign through the keyring service: it must be neither the
+// Keystone server key nor the key of a user, registered or not.
+func (k *keyringServer) checkSignable(label string) error {
+
+	if label == k.ServerKeyLabel {
+		return errors.New("the Keystone server key cannot be used")
+	}
+
+	if strings.HasPrefix(label, USER_KEY_LABEL_PREFIX) {
+		return fmt.Errorf("key %s belongs to a user", label)
+	}
+
+	_, err := k.Registry.ByKeyLabel(label)
+
+	if err == nil {
+		return fmt.Errorf("key %s belongs to a registered user", label)
+	}
+
+	if err != errNotRegistered {
+		return err
+	}
+
+	return nil
+}
+
+// signingProfile maps a protobuf signing profile onto the keys
+// package signing profile, returning the plaintext that should be
+// passed to the key for signing. Profiles which hash before a
+// standard (DER, non-normalized) ECDSA signature are hashed here.
+func signingProfile(profile keystonepb.SigningProfile, plaintext []byte) ([]byte, keys.SigningProfile, error) {
+	switch profile {
+	case keystonepb.SigningProfile_PROFILE_BC_ECDSA_SHA256:
+		return plaintext, keys.SIGNING_OPTS_BC_ECDSA_SHA256, nil
+	case keystonepb.SigningProfile_PROFILE_ECDSA_SHA256:
+		digest := sha256.Sum256(plaintext)
+		return digest[:], keys.SIGNING_OPTS_ECDSA, nil
+	case keystonepb.SigningProfile_PROFILE_ECDSA_NOHASH:
+		return plaintext, keys.SIGNING_OPTS_ECDSA, nil
+	case keystonepb.SigningProfile_PROFILE_EDDSA:
+		return plaintext, keys.SIGNING_OPTS_EDDSA, nil
+	default:
+		return nil, 0, keys.ErrUnsupportedProfile
+	}
+}
+
+func signedError(status int32) *keystonepb.Signed {
+	return &keystonepb.Signed{SignedUnion: &keystonepb.Signed_Error{Error: status}}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/regen-network/keystone/keys"
+	keystonepb "github.com/regen-network/keystone/keystoned/proto"
+)
+
+func TestSigningProfile(t *testing.T) {
+	plaintext := []byte("sign me")
+	digest := sha256.Sum256(plaintext)
+
+	msg, profile, err := signingProfile(keystonepb.SigningProfile_PROFILE_BC_ECDSA_SHA256, plaintext)
+	require.NoError(t, err)
+	require.Equal(t, keys.SIGNING_OPTS_BC_ECDSA_SHA256, profile)
+	require.Equal(t, plaintext, msg)
+
+	// Standard ECDSA does not hash, so the digest is passed to the key
+	msg, profile, err = signingProfile(keystonepb.SigningProfile_PROFILE_ECDSA_SHA256, plaintext)
+	require.NoError(t, err)
+	require.Equal(t, keys.SIGNING_OPTS_ECDSA, profile)
+	require.Equal(t, digest[:], msg)
+
+	msg, profile, err = signingProfile(keystonepb.SigningProfile_PROFILE_ECDSA_NOHASH, plaintext)
+	require.NoError(t, err)
+	require.Equal(t, keys.SIGNING_OPTS_ECDSA, profile)
+	require.Equal(t, plaintext, msg)
+
+	msg, profile, err = signingProfile(keystonepb.SigningProfile_PROFILE_EDDSA, plaintext)
+	require.NoError(t, err)
+	require.Equal(t, keys.SIGNING_OPTS_EDDSA, profile)
+	require.Equal(t, plaintext, msg)
+}
+
+func TestSigningProfileUnsupported(t *testing.T) {
+	// The value of the removed PROFILE_BC_ECDSA_SHA512
+	_, _, err := signingProfile(keystonepb.SigningProfile(1), []byte("sign me"))
+	require.ErrorIs(t, err, keys.ErrUnsupportedProfile)
+
+	_, _, err = signingProfile(keystonepb.SigningProfile(99), []byte("sign me"))
+	require.ErrorIs(t, err, keys.ErrUnsupportedProfile)
+}
+
+func TestKeyringServerRefusesUserKeys(t *testing.T) {
+	k := &keyringServer{Keyring: keys.NewInMemoryKeyring(), ServerKeyLabel: "keystone", Registry: &dbRegistry{db: dbm.NewMemDB()}}
+	ctx := context.Background()
+
+	// User key labels are reserved
+	_, err := k.NewKey(ctx, &keystonepb.KeySpec{Label: USER_KEY_LABEL_PREFIX + "regen1device"})
+	require.Error(t, err)
+
+	_, err = k.Keyring.NewKey(keys.KEYGEN_SECP256K1, USER_KEY_LABEL_PREFIX+"regen1device")
+	require.NoError(t, err)
+
+	_, err = k.Keyring.NewKey(keys.KEYGEN_SECP256K1, "keystone")
+	require.NoError(t, err)
+
+	// Neither unregistered user keys nor the server key may sign
+	for _, label := range []string{USER_KEY_LABEL_PREFIX + "regen1device", "keystone"} {
+		signed, err := k.Sign(ctx, &keystonepb.Msg{
+			KeySpec: &keystonepb.KeySpec{Label: label},
+			Content: &keystonepb.Signable{SignableUnion: &keystonepb.Signable_SignableBytes{SignableBytes: []byte("sign me")}},
+		})
+		require.NoError(t, err)
+		require.Equal(t, STATUS_UNAUTHORIZED, signed.GetError())
+	}
+
+	// Other keys may
+	ref, err := k.NewKey(ctx, &keystonepb.KeySpec{Label: "other"})
+	require.NoError(t, err)
+
+	signed, err := k.Sign(ctx, &keystonepb.Msg{
+		KeySpec: &keystonepb.KeySpec{Label: *ref.Label},
+		Content: &keystonepb.Signable{SignableUnion: &keystonepb.Signable_SignableBytes{SignableBytes: []byte("sign me")}},
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, signed.GetSignedBytes())
+}
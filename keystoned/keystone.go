@@ -2,303 +2,532 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"strconv"
 	"flag"
+	"time"
 
+	rpcclient "github.com/tendermint/tendermint/rpc/client"
 	"google.golang.org/grpc"
 
 	"github.com/cosmos/cosmos-sdk/client"
 	"github.com/cosmos/cosmos-sdk/client/flags"
-	clienttx "github.com/cosmos/cosmos-sdk/client/tx"
 	"github.com/cosmos/cosmos-sdk/crypto/keyring"
 	"github.com/cosmos/cosmos-sdk/types/tx"
-	"github.com/regen-network/regen-ledger/x/group"
 
 	sdk "github.com/cosmos/cosmos-sdk/types"
-	authclient "github.com/cosmos/cosmos-sdk/x/auth/client"
 	acc "github.com/cosmos/cosmos-sdk/x/auth/types"
+	banktypes "github.com/cosmos/cosmos-sdk/x/bank/types"
 
+	"github.com/regen-network/keystone/keys"
 	keystonepb "github.com/regen-network/keystone/keystoned/proto"
 )
 
+// USER_KEY_LABEL_PREFIX is prefixed to the address of a registering
+// device to give the label of the key created for its user.
+const USER_KEY_LABEL_PREFIX = "user/"
+
+// Status codes returned in the Status field of Keystone service
+// responses
+const (
+	STATUS_OK int32 = iota
+	STATUS_BAD_REQUEST
+	STATUS_KEY_NOT_FOUND
+	STATUS_SIGNING_FAILED
+	STATUS_TX_FAILED
+	STATUS_UNAUTHORIZED
+	STATUS_REGISTRY_FAILED
+)
+
 type server struct{
+	keystonepb.UnimplementedKeystoneServiceServer
 	ServerAddress    string
 	ChainID          string
 	KeyringType      string
 	KeyringDir       string
 	RpcURI           string
-}
-
-//adminMembers returns a []group.Member with two members
-func adminMembers( addr1 string, addr2 string ) []group.Member{
-	
-	member1 := group.Member{
-		Address:  addr1,
-		Weight:   strconv.Itoa(1),
-	}
-
-	member2 := group.Member{
-		Address:  addr2,
-		Weight:   strconv.Itoa(1),
-	}
-	
-	return []group.Member{member1, member2}
+	RpcClient        rpcclient.Client
+	Keyring          keys.Keyring
+	SigningKey       *keys.CryptoKey
+	ServerGroup      string
+	CosmosKeyring    keyring.Keyring
+	ChainConn        *grpc.ClientConn
+	BroadcastMode    tx.BroadcastMode
+	TxTimeout        time.Duration
+	GasAdjustment    float64
+	GasPrices        sdk.DecCoins
+	Sequences        *sequenceManager
+	AdminGroupPolicy thresholdPolicy
+	KeyGroupPolicy   thresholdPolicy
+	MaxMetadataLen   int
+	RequireAuth      bool
+	MaxClockSkew     time.Duration
+	Nonces           nonceStore
+	Registry         userRegistry
+	UserFunding      sdk.Coins
+	Registering      *registrationLocks
 }
 
 // Register implements the method given in the protobuf definition for
-// the Keystone service (proto/keystone.proto)
+// the Keystone service (proto/keystone.proto), following the steps in
+// spec/01_concepts.md:
+//
+//  1. If no address is passed in the request, a key is created in the
+//     Keystone keystore for the registering device, and its address
+//     used for the user. The account is funded by the Keystone server
+//     key, if configured to, so that the user can pay for their own
+//     transactions, but only for devices with a verified client
+//     certificate
+//  2. An admin group is created, whose members are the user and the
+//     Keystone server group, and the registering device if Keystone
+//     created the user's key
+//  3. A key group is created with the same members, administered by
+//     the admin group
+//
+// The transactions are signed with the Keystone server key, which
+// then hands administration of both groups to the admin group.
 func (s *server) Register(ctx context.Context, in *keystonepb.RegisterRequest) (*keystonepb.RegisterResponse, error) {
 	log.Printf("Receive message body from client: %s %v", in.Address, in.EncryptedKey)
 
-	var addr1 sdk.AccAddress = nil
+	var userAddr sdk.AccAddress = nil
+	var keyLabel string
 	var err error
 
 	// If an address is passed in via the request, then use that address
-	// to create the group, otherwise create a new address for the group
+	// as the user member of the groups, otherwise a new key and address
+	// are created for the user once the request has been validated
 	
 	if len(in.Address) > 0 {
 		log.Printf("Address passed in request")
-		addr1, err = sdk.AccAddressFromBech32(in.Address)
+		userAddr, err = sdk.AccAddressFromBech32(in.Address)
 
 		if err != nil {
 			log.Println("Address conversion from bech32 failed")
 			return nil, err
 		}
-	} else {
-		
-		addr1, err = sdk.AccAddressFromBech32(s.ServerAddress)
-		
+
+		// Only the holder of a key may register it
+		err = s.authorizeAddress(ctx, in.Address)
+
 		if err != nil {
-			log.Println("Address conversion from bech32 failed")
-			return nil, err
+			log.Printf("Unauthorized register request: %s", err.Error())
+			return &keystonepb.RegisterResponse{Status: STATUS_UNAUTHORIZED}, nil
+		}
+
+		// The address is held until its registration is recorded, so
+		// that a concurrent request cannot pass the check below too
+		if !s.Registering.tryLock(in.Address) {
+			log.Printf("Address %s is already being registered", in.Address)
+			return &keystonepb.RegisterResponse{Status: STATUS_BAD_REQUEST}, nil
+		}
+
+		defer s.Registering.unlock(in.Address)
+
+		if _, err = s.Registry.ByAddress(in.Address); err != errNotRegistered {
+			log.Printf("Address %s is already registered", in.Address)
+			return &keystonepb.RegisterResponse{Status: STATUS_BAD_REQUEST}, nil
+		}
+
+		// The caller is the holder of the address, so is recorded as
+		// its registering device, which may only register once
+		if _, err = s.Registry.ByDevice(in.Address); err != errNotRegistered {
+			log.Printf("Device %s has already registered", in.Address)
+			return &keystonepb.RegisterResponse{Status: STATUS_BAD_REQUEST}, nil
+		}
+	}
+
+	// A user without an address is registered by their device, which
+	// may only do so once, as each registration creates (and may
+	// fund) a new key
+	var device string
+
+	if len(in.Address) == 0 {
+		c, ok := callerFromContext(ctx)
+
+		if !ok {
+			log.Println("Register request without an address is not from an authenticated device")
+			return &keystonepb.RegisterResponse{Status: STATUS_UNAUTHORIZED}, nil
 		}
-	}	
-	
-	localContext, err := getLocalContext(*s)
+
+		device = c.Address.String()
+
+		if !s.Registering.tryLock(device) {
+			log.Printf("Device %s is already registering", device)
+			return &keystonepb.RegisterResponse{Status: STATUS_BAD_REQUEST}, nil
+		}
+
+		defer s.Registering.unlock(device)
+
+		if _, err = s.Registry.ByDevice(device); err != errNotRegistered {
+			log.Printf("Device %s has already registered", device)
+			return &keystonepb.RegisterResponse{Status: STATUS_BAD_REQUEST}, nil
+		}
+
+		// Device keys cost nothing to make, so funding, which costs the
+		// Keystone account, is only given to devices holding a client
+		// certificate issued by the operator
+		if !s.UserFunding.IsZero() && !verifiedClientCert(ctx) {
+			log.Printf("Device %s has no verified client certificate for a funded registration", device)
+			return &keystonepb.RegisterResponse{Status: STATUS_UNAUTHORIZED}, nil
+		}
+	}
+
+	groupMeta, userMeta, err := registerMetadata(in.Metadata, s.MaxMetadataLen)
 
 	if err != nil {
-		fmt.Println("Error getting local node context: ", err)
-		return nil, err
+		log.Printf("Invalid metadata: %s", err.Error())
+		return &keystonepb.RegisterResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
+
+	keyGroupPolicy := s.KeyGroupPolicy
+
+	if in.KeyGroupPolicy != nil {
+		keyGroupPolicy = policyFromProto(in.KeyGroupPolicy)
 	}
 
-	// @@todo: create key/address and use that as creator address
-	// may need to first create a key/address if one not sent in request
-	// as "from" address (creator) must already exist
-	groupAddress, err := createGroup([]byte(addr1.String()), adminMembers(addr1.String(), addr1.String()), "", localContext)
+	// The member weights do not depend on the user address, which is
+	// not known yet if a key is to be created
+	total, err := totalWeight(adminMembers(in.Address, s.ServerGroup))
 
 	if err != nil {
-		fmt.Println("Error creating group: ", err)
 		return nil, err
 	}
 
-	log.Println("Group: ", groupAddress)
-
-	return &keystonepb.RegisterResponse{Greeting: "Hello From the Server!", Status: 0}, nil
-}
+	adminTotal := total
 
-func (s *server) Sign(ctx context.Context, in *keystonepb.SignRequest) (*keystonepb.SignResponse, error) {
-	return &keystonepb.SignResponse{Status: -1, SignedBytes: []byte{}}, nil
-}
+	if len(device) > 0 {
+		adminTotal = adminTotal.Add(sdk.OneDec())
+	}
 
-// go relayer/block explorer examples?
+	err = keyGroupPolicy.validate(&total)
 
-// how to retrieve node context beyond this one transaction?
-func getLocalContext(s server) (*client.Context, error) {
+	if err != nil {
+		log.Printf("Invalid key group policy: %s", err.Error())
+		return &keystonepb.RegisterResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
 
-	addr, err := sdk.AccAddressFromBech32(s.ServerAddress)
-	encodingConfig := makeEncodingConfig()
+	err = s.AdminGroupPolicy.validate(&adminTotal)
 
 	if err != nil {
+		log.Printf("Invalid admin group policy: %s", err.Error())
 		return nil, err
 	}
 
-	rpcclient, err := client.NewClientFromNode(s.RpcURI)
+	chain, err := s.chainClient()
 
 	if err != nil {
+		fmt.Println("Error getting local node context: ", err)
 		return nil, err
 	}
 
-	//@@TODO configure keyring.BackendTest using the server-global context, not hardcode
-	k, err := keyring.New(sdk.KeyringServiceName(), keyring.BackendTest, s.KeyringDir, nil)
+	if userAddr == nil {
+		key, err := s.userKey(device)
 
-	// l, err := k.List()
+		if err != nil {
+			log.Printf("Error creating user key: %s", err.Error())
+			return nil, err
+		}
+
+		userAddr = keyAddress(key)
+		keyLabel = key.Label
+
+		// The key is kept if registration fails, and its label
+		// reported, so that it is not lost along with any funds sent
+		// to it. A retry by the device uses the same key, which is only
+		// topped up to the funding amount
+		err = s.fundAccount(userAddr, chain)
+
+		if err != nil {
+			return &keystonepb.RegisterResponse{Status: STATUS_TX_FAILED, UserAddress: userAddr.String(), KeyLabel: keyLabel, Transactions: txResults(chain.Results)}, nil
+		}
+	}
 
-	// fmt.Printf("%v", l)
+	// The registering device of a user whose key is held by Keystone is
+	// also a member of their admin group, so that it can manage the
+	// user's groups, and add new devices if it is lost
+	members := adminMembers(userAddr.String(), s.ServerGroup)
+	adminGroupMembers := members
+
+	if len(device) > 0 {
+		adminGroupMembers = append(adminMembers(userAddr.String(), s.ServerGroup), deviceMember(device, userMeta))
+	} else {
+		members[0].Metadata = userMeta
+	}
+
+	// Failed transactions are reported in the response, along with
+	// those that were sent before them
+	adminGroupID, adminAddress, err := createAdminGroup(s.SigningKey, adminGroupMembers, groupMeta, s.AdminGroupPolicy, chain)
 
 	if err != nil {
-		fmt.Printf("error opening keyring: ", err)
-		return nil, err
+		fmt.Println("Error creating admin group: ", err)
+		return &keystonepb.RegisterResponse{Status: STATUS_TX_FAILED, UserAddress: userAddr.String(), KeyLabel: keyLabel, Transactions: txResults(chain.Results)}, nil
 	}
 
-	c := client.Context{FromAddress: addr, ChainID: s.ChainID}.
-		WithCodec(encodingConfig.Marshaler).
-		WithInterfaceRegistry(encodingConfig.InterfaceRegistry).
-		WithTxConfig(encodingConfig.TxConfig).
-		WithLegacyAmino(encodingConfig.Amino).
-		WithBroadcastMode(flags.BroadcastSync).
-		WithNodeURI(s.RpcURI).
-		WithAccountRetriever(acc.AccountRetriever{}).
-		WithClient(rpcclient).
-		WithKeyringDir(s.KeyringDir).
-		WithKeyring(k)
+	log.Printf("Admin group: %d %s", adminGroupID, adminAddress)
 
-	return &c, nil
+	keyGroupID, keyGroupAddress, err := createKeyGroup(s.SigningKey, members, groupMeta, keyGroupPolicy, adminGroupID, adminAddress, chain)
+
+	if err != nil {
+		fmt.Println("Error creating key group: ", err)
+		return &keystonepb.RegisterResponse{Status: STATUS_TX_FAILED, UserAddress: userAddr.String(), KeyLabel: keyLabel, Transactions: txResults(chain.Results)}, nil
+	}
+
+	log.Printf("Key group: %d %s", keyGroupID, keyGroupAddress)
+
+	reg := &keystonepb.Registration{
+		UserAddress:       userAddr.String(),
+		KeyLabel:          keyLabel,
+		AdminGroupId:      adminGroupID,
+		AdminGroupAddress: adminAddress,
+		KeyGroupId:        keyGroupID,
+		KeyGroupAddress:   keyGroupAddress,
+		RegisteredAt:      time.Now().Unix(),
+	}
+
+	if c, ok := callerFromContext(ctx); ok {
+		reg.DeviceAddress = c.Address.String()
+	}
+
+	res := &keystonepb.RegisterResponse{
+		Status:            STATUS_OK,
+		UserAddress:       userAddr.String(),
+		KeyLabel:          keyLabel,
+		AdminGroupAddress: adminAddress,
+		KeyGroupAddress:   keyGroupAddress,
+		AdminGroupId:      adminGroupID,
+		KeyGroupId:        keyGroupID,
+		Transactions:      txResults(chain.Results),
+	}
+
+	// The groups are on chain by now, so are reported even if the
+	// registration cannot be recorded
+	err = s.Registry.Put(reg)
+
+	if err != nil {
+		log.Printf("Error recording registration of %s: %s", userAddr.String(), err.Error())
+		res.Status = STATUS_REGISTRY_FAILED
+	}
+
+	return res, nil
 }
 
-func createAdminGroup(creatorAddress []byte, memberList []group.Member, metadata string, localContext *client.Context) ([]byte, error) {
-	return createGroup( creatorAddress, memberList, metadata, localContext )
+// txResults returns the final code, log and height of the given
+// transactions, for reporting in a Keystone service response.
+func txResults(results []*sdk.TxResponse) []*keystonepb.TxResult {
+
+	txs := make([]*keystonepb.TxResult, 0, len(results))
+
+	for _, res := range results {
+		txs = append(txs, &keystonepb.TxResult{
+			TxHash: res.TxHash,
+			Code:   res.Code,
+			RawLog: res.RawLog,
+			Height: res.Height,
+		})
+	}
+
+	return txs
 }
-	
-// something like this to abstract the tx building for multiple messages -- func createTx( txcfg params.EncodingConfig,
 
-// CreateGroup creates a Cosmos Group using the MsgCreateGroup, filling the message with the input fields
-func createGroup(creatorAddress []byte, memberList []group.Member, metadata string, localContext *client.Context) ([]byte, error) {
+// userKey returns the key in the Keystone keystore for a user who
+// has not given an address, registered by the given device. The key
+// is created the first time, and its label is derived from the device
+// address, so that the same key is used if the device has to retry
+// its registration. The user address is that of the key's public key.
+func (s *server) userKey(device string) (*keys.CryptoKey, error) {
 
-	encCfg := makeEncodingConfig()
-	txBuilder := encCfg.TxConfig.NewTxBuilder()
+	label := USER_KEY_LABEL_PREFIX + device
+	key, err := s.Keyring.Key(label)
 
-	// @@todo, how to get the private key from the keyring
-	// associated with this address?
-	adminAddr, err := sdk.AccAddressFromBech32(string(creatorAddress))
+	if err == nil {
+		log.Printf("Using existing user key: %s", label)
+		return key, nil
+	}
 
-	if err != nil {
-		fmt.Printf("Error converting address string: ", err)
+	if !errors.Is(err, keys.ErrKeyNotFound) {
 		return nil, err
 	}
 
-	err = localContext.AccountRetriever.EnsureExists(*localContext, adminAddr)
+	key, err = s.Keyring.NewKey(keys.KEYGEN_SECP256K1, label)
 
 	if err != nil {
-		fmt.Println("Account does not exist because: ", err)
 		return nil, err
 	}
 
-	num, seq, err := localContext.AccountRetriever.GetAccountNumberSequence(*localContext, adminAddr)
+	log.Printf("Created user key: %s", key.Label)
 
-	if err != nil {
-		fmt.Printf("Error retrieving account number/sequence: ", err)
-		return nil, err
-	} else {
-		fmt.Printf("Account retrieved: %v with seq: %v", num, seq)
+	return key, nil
+}
+
+// fundAccount sends from the Keystone key to a new user account (which
+// creates the account on chain) whatever it lacks of the configured
+// user funding, so that a user is never funded more than once, however
+// often their registration is retried. Nothing is sent if the account
+// already holds the funding amount.
+func (s *server) fundAccount(to sdk.AccAddress, chain *chainClient) error {
+
+	if s.UserFunding.IsZero() {
+		return nil
 	}
 
-	//txBuilder := localContext.TxConfig.NewTxBuilder()
-	txBuilder.SetMsgs(&group.MsgCreateGroup{
-		Admin:    adminAddr.String(),
-		Members:  memberList,
-		Metadata: nil,
-	})
+	res, err := banktypes.NewQueryClient(s.ChainConn).AllBalances(context.Background(), &banktypes.QueryAllBalancesRequest{Address: to.String()})
 
-	txBuilder.SetFeeAmount(sdk.Coins{sdk.NewInt64Coin("uregen", 5000)})
-	txBuilder.SetGasLimit(50000)
+	if err != nil {
+		log.Printf("Error querying balance of %s: %s", to.String(), err.Error())
+		return err
+	}
 
-	txFactory := clienttx.Factory{}
-	txFactory = txFactory.
-		WithChainID(localContext.ChainID).
-		WithKeybase(localContext.Keyring).
-		WithTxConfig(encCfg.TxConfig)
+	amount := fundingShortfall(s.UserFunding, res.Balances)
 
-	// Only needed for "offline" accounts?
-	//.WithAccountNumber(num).WithSequence(seq)
+	if amount.IsZero() {
+		log.Printf("Account %s is already funded", to.String())
+		return nil
+	}
 
-	info, err := txFactory.Keybase().Key("delegator")
+	_, err = chain.sendTx(&txRequest{Signer: s.SigningKey, Msgs: []sdk.Msg{banktypes.NewMsgSend(keyAddress(s.SigningKey), to, amount)}})
 
 	if err != nil {
-		return nil, err
+		log.Printf("Error funding account %s: %s", to.String(), err.Error())
+		return err
 	}
 
-	fmt.Printf("%v", info)
+	log.Printf("Funded account %s with %s", to.String(), amount.String())
 
-	// NOT NEEDED IF USING SignTx from the x/auth/client, which
-	// does all these things
-	// signerData := xauthsigning.SignerData{
-	// 	ChainID:       MY_CHAIN,
-	// 	AccountNumber: num,
-	// 	Sequence:      seq,
-	// }
+	return nil
+}
 
-	// signBytes, err := localContext.TxConfig.SignModeHandler().GetSignBytes(signing.SignMode_SIGN_MODE_DIRECT, signerData, txBuilder.GetTx())
+// fundingShortfall returns the amount, of each denom in the funding,
+// by which the balance falls short of it.
+func fundingShortfall(funding sdk.Coins, balance sdk.Coins) sdk.Coins {
 
-	// if err != nil{
-	// 	fmt.Println("Error getting signed bytes: ", err)
-	// 	return nil, err
-	// }
+	shortfall := sdk.Coins{}
 
-	txJSON, err := localContext.TxConfig.TxJSONEncoder()(txBuilder.GetTx())
+	for _, coin := range funding {
+		held := balance.AmountOf(coin.Denom)
 
-	if err != nil {
-		fmt.Println("Error getting JSON: ", err)
-		return nil, err
+		if held.LT(coin.Amount) {
+			shortfall = append(shortfall, sdk.NewCoin(coin.Denom, coin.Amount.Sub(held)))
+		}
 	}
 
-	fmt.Printf("Unsigned TX %s\n", txJSON)
+	return shortfall
+}
 
-	err = authclient.SignTx(txFactory, *localContext, "validator", txBuilder, false, true)
+// Sign implements the method given in the protobuf definition for
+// the Keystone service (proto/keystone.proto). The key with the
+// requested label is retrieved from the server keyring and used to
+// sign the given bytes with the default signing profile for its key
+// type: for ECDSA keys, the blockchain profile (SHA-256, low-s
+// normalized, raw r||s), and for Ed25519 keys, EdDSA.
+//
+// Signing must be initiated by the user, so the request must carry a
+// valid signature by the user's device before the key is used, and
+// only the keys of registered users may be used, by their devices.
+func (s *server) Sign(ctx context.Context, in *keystonepb.SignRequest) (*keystonepb.SignResponse, error) {
+	log.Printf("Sign request for key: %s", in.KeyLabel)
 
-	if err != nil {
-		fmt.Println("Error signing: ", err)
-		return nil, err
+	if len(in.KeyLabel) == 0 || len(in.ForSigning) == 0 {
+		log.Println("Sign request missing key label or bytes for signing")
+		return &keystonepb.SignResponse{Status: STATUS_BAD_REQUEST}, nil
 	}
 
-	txBytes, err := localContext.TxConfig.TxEncoder()(txBuilder.GetTx())
+	device, err := s.verifySignRequest(ctx, in)
 
 	if err != nil {
-		fmt.Println("Error encoding transaction: ", err)
-		return nil, err
+		log.Printf("Sign request device proof rejected: %s", err.Error())
+		return &keystonepb.SignResponse{Status: STATUS_UNAUTHORIZED}, nil
 	}
 
-	txJSON, err = localContext.TxConfig.TxJSONEncoder()(txBuilder.GetTx())
+	deviceAddr := sdk.AccAddress(device.Address()).String()
+	log.Printf("Sign request from device: %s", deviceAddr)
+
+	// Only keys held for registered users may be used, by their devices
+	reg, err := s.Registry.ByKeyLabel(in.KeyLabel)
 
 	if err != nil {
-		fmt.Println("Error getting JSON: ", err)
-		return nil, err
+		log.Printf("No registered user for key %s: %s", in.KeyLabel, err.Error())
+		return &keystonepb.SignResponse{Status: STATUS_KEY_NOT_FOUND}, nil
 	}
 
-	fmt.Printf("Signed TX %s\n", txJSON)
+	err = s.authorizeDevice(reg, deviceAddr)
+
+	if err != nil {
+		log.Printf("Unauthorized sign request: %s", err.Error())
+		return &keystonepb.SignResponse{Status: STATUS_UNAUTHORIZED}, nil
+	}
 
-	//res, err := localContext.BroadcastTx(txBytes)
+	key, err := s.Keyring.Key(in.KeyLabel)
 
-	// @@TODO: use secure connection?
-	opts := grpc.WithInsecure()
+	if err != nil {
+		log.Printf("Error retrieving key for signing: %s", err.Error())
+		return &keystonepb.SignResponse{Status: STATUS_KEY_NOT_FOUND}, nil
+	}
 
-	// @@TODO: configure the dial location from server context
-	grpcConn, err := grpc.Dial("127.0.0.1:9090", opts)
+	signed, err := key.Sign(in.ForSigning, nil)
 
 	if err != nil {
-		fmt.Println("Err doing grpc dial: ", err)
-		return nil, err
+		log.Printf("Error signing: %s", err.Error())
+		return &keystonepb.SignResponse{Status: STATUS_SIGNING_FAILED}, nil
 	}
 
-	defer grpcConn.Close()
+	return &keystonepb.SignResponse{
+		Status:      STATUS_OK,
+		SignedBytes: signed,
+		PublicKey:   key.PubKey().Bytes(),
+	}, nil
+}
 
-	// @@TODO: configure broadcast mode from server-global context?
-	
-	txClient := tx.NewServiceClient(grpcConn)
+// chainClient returns a client for sending transactions to the chain
+// for a single request, with the server broadcast configuration. The
+// chain gRPC connection and RPC client are shared by every request.
+func (s *server) chainClient() (*chainClient, error) {
 
-	res, err := txClient.BroadcastTx(
-		context.Background(),
-		&tx.BroadcastTxRequest{
-			Mode:    tx.BroadcastMode_BROADCAST_MODE_SYNC,
-			TxBytes: txBytes,
-		},
-	)
+	localContext, err := getLocalContext(*s)
 
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println(res.TxResponse.Code) // Should be `0` if the tx is successful
+	return &chainClient{
+		Context:       localContext,
+		Conn:          s.ChainConn,
+		BroadcastMode: s.BroadcastMode,
+		Timeout:       s.TxTimeout,
+		Fee: feePolicy{
+			GasAdjustment: s.GasAdjustment,
+			GasPrices:     s.GasPrices,
+		},
+		Sequences: s.Sequences,
+	}, nil
+}
+
+// go relayer/block explorer examples?
+
+// how to retrieve node context beyond this one transaction?
+func getLocalContext(s server) (*client.Context, error) {
+
+	addr, err := sdk.AccAddressFromBech32(s.ServerAddress)
+	encodingConfig := makeEncodingConfig()
 
 	if err != nil {
-		fmt.Println("Error broadcasting ", err)
+		return nil, err
 	}
 
-	fmt.Printf("Result: %v", res)
+	c := client.Context{FromAddress: addr, ChainID: s.ChainID}.
+		WithCodec(encodingConfig.Marshaler).
+		WithInterfaceRegistry(encodingConfig.InterfaceRegistry).
+		WithTxConfig(encodingConfig.TxConfig).
+		WithLegacyAmino(encodingConfig.Amino).
+		WithBroadcastMode(flags.BroadcastSync).
+		WithNodeURI(s.RpcURI).
+		WithAccountRetriever(acc.AccountRetriever{}).
+		WithClient(s.RpcClient).
+		WithKeyringDir(s.KeyringDir).
+		WithKeyring(s.CosmosKeyring)
 
-	return []byte{}, nil
+	return &c, nil
 }
 
 func main() {
@@ -307,10 +536,39 @@ func main() {
 	// Most have likely-reasonable defaults.
 	keystoneAddress := flag.String("key-addr", "", "the address associated with the key used to sign transactions on behalf of Keystone")
 	blockchain := flag.String("chain-id", "test-chain", "the blockchain that Keystone should connect to")
-	keyringType := flag.String("keyring-type", "test", "the keyring backend type where keys should be read from")
+	keyringType := flag.String("keyring-type", "test", "the keyring backend type where keys should be read from: os, file (whose passphrase is read from " + KEYRING_PASSPHRASE_ENV + "), test, memory or pkcs11")
 	keyringDir := flag.String("keyring-dir", "~/.regen/", "the directory where the keys are")
 	chainRpcURI := flag.String("chain-rpc", "tcp://localhost:26657", "the address of the RPC endpoint to communicate with the blockchain")
+	chainGrpcAddress := flag.String("chain-grpc", "127.0.0.1:9090", "the address of the gRPC endpoint of the blockchain node, to which transactions are broadcast")
+	chainGrpcTLS := flag.Bool("chain-grpc-tls", false, "use TLS for the connection to the blockchain gRPC endpoint")
+	chainGrpcCA := flag.String("chain-grpc-ca", "", "the path to a PEM bundle of CA certificates used to verify the blockchain gRPC endpoint, instead of the system roots")
+	chainGrpcCert := flag.String("chain-grpc-cert", "", "the path to a PEM client certificate presented to the blockchain gRPC endpoint")
+	chainGrpcKey := flag.String("chain-grpc-key", "", "the path to the PEM private key for the client certificate")
+	broadcastMode := flag.String("broadcast-mode", "sync", "how transactions are broadcast to the blockchain: sync, async or block; transactions are then tracked until included in a block")
+	txTimeout := flag.Duration("tx-timeout", TX_WAIT_TIMEOUT, "how long to wait for a broadcast transaction to be included in a block")
+	gasAdjustment := flag.Float64("gas-adjustment", 1.5, "the multiple of the simulated gas use of a transaction which is set as its gas limit")
+	gasPrices := flag.String("gas-prices", "0.1uregen", "the price per unit of gas paid in transaction fees, e.g. 0.1uregen")
+	adminGroupThreshold := flag.String("admin-group-threshold", ADMIN_GROUP_THRESHOLD, "the threshold weight of the decision policy of users' admin groups, whose members (the user and the server group) have weight 1 each")
+	keyGroupThreshold := flag.String("key-group-threshold", KEY_GROUP_THRESHOLD, "the default threshold weight of the decision policy of users' key groups, whose members have weight 1 each")
+	maxMetadataLen := flag.Int("max-metadata-len", MAX_METADATA_LEN, "the maximum length in bytes of group and member metadata accepted by the chain")
+	policyTimeout := flag.Duration("policy-timeout", GROUP_POLICY_TIMEOUT, "the time for which proposals to users' groups are open for votes")
 	grpcListenPort := flag.String("listen-port", "8080", "the port where the server will listen for connections")
+	keystoreType := flag.String("keystore", "pkcs11", "where Keystone keys are held: pkcs11 (an HSM), file (encrypted software keys) or memory (software keys, for testing only)")
+	pkcs11Config := flag.String("pkcs11-config", "./pkcs11-config", "the path to the PKCS11 configuration file for the HSM holding Keystone keys")
+	keystoreFile := flag.String("keystore-file", "./keystone-keys", "the path to the encrypted key file used by the file keystore, whose passphrase is read from " + KEYSTORE_PASSPHRASE_ENV)
+	serverGroup := flag.String("server-group", "", "the address of the Keystone server member of every user's groups, which must (for now) be the key-addr address, as the Keystone key makes and votes on proposals to those groups")
+	listenTLSCert := flag.String("listen-tls-cert", "", "the path to the PEM certificate presented by the server to its clients; TLS is not used if none is given")
+	listenTLSKey := flag.String("listen-tls-key", "", "the path to the PEM private key for the server certificate")
+	listenClientCA := flag.String("listen-client-ca", "", "the path to a PEM bundle of CA certificates used to verify client certificates, which callers of the keyring service must present")
+	requireAuth := flag.Bool("auth", true, "require Keystone service requests to be signed by the caller's device key, and keyring service callers to present a verified client certificate")
+	authMaxSkew := flag.Duration("auth-max-skew", AUTH_MAX_CLOCK_SKEW, "how far the timestamp of a signed request, or of the device proof of a sign request, may be from the server clock")
+	nonceStoreType := flag.String("nonce-store", "leveldb", "where the nonces of request envelopes and sign requests are recorded to prevent replays: leveldb (on disk) or memory (for testing only)")
+	nonceStoreDir := flag.String("nonce-store-dir", "./keystone-data", "the directory holding the leveldb nonce store")
+	nonceGCInterval := flag.Duration("nonce-gc-interval", NONCE_GC_INTERVAL, "the interval between removals of expired nonces from the nonce store")
+	registryType := flag.String("registry", "leveldb", "where user registrations are recorded: leveldb (on disk) or memory (for testing only)")
+	registryDir := flag.String("registry-dir", "./keystone-data", "the directory holding the leveldb user registry")
+	userFunding := flag.String("user-funding", "", "the amount sent from the Keystone address to each user account created by Register, for devices with a verified client certificate, e.g. 1000000uregen; none if empty")
+	keyLabel := flag.String("key-label", "keystone", "the label of the key in the keystore used to sign transactions on behalf of Keystone")
 
 	flag.Parse()
 
@@ -319,6 +577,140 @@ func main() {
 		return
 	}
 
+	mode, err := parseBroadcastMode(*broadcastMode)
+
+	if err != nil {
+		log.Fatalln("Invalid broadcast mode:", err)
+	}
+
+	prices, err := sdk.ParseDecCoins(*gasPrices)
+
+	if err != nil || prices.IsZero() {
+		log.Fatalln("Invalid gas prices:", *gasPrices)
+	}
+
+	funding, err := sdk.ParseCoinsNormalized(*userFunding)
+
+	if err != nil {
+		log.Fatalln("Invalid user funding:", *userFunding)
+	}
+
+	adminGroupPolicy := thresholdPolicy{Threshold: *adminGroupThreshold, Timeout: *policyTimeout}
+	keyGroupPolicy := thresholdPolicy{Threshold: *keyGroupThreshold, Timeout: *policyTimeout}
+
+	if err = adminGroupPolicy.validate(nil); err != nil {
+		log.Fatalln("Invalid admin group policy:", err)
+	}
+
+	if err = keyGroupPolicy.validate(nil); err != nil {
+		log.Fatalln("Invalid key group policy:", err)
+	}
+
+	keystore, err := openKeystore(*keystoreType, *pkcs11Config, *keystoreFile)
+
+	if err != nil {
+		log.Fatalln("Failed to open keystore:", err)
+	}
+
+	signingKey, err := keystore.Key(*keyLabel)
+
+	if err != nil {
+		log.Fatalln("Failed to load Keystone signing key:", err)
+	}
+
+	// The signing key must be the one which controls the Keystone
+	// blockchain address, or its transactions will be rejected
+	if keyAddress(signingKey).String() != *keystoneAddress {
+		log.Fatalf("Keystone signing key %s has address %s, not %s", *keyLabel, keyAddress(signingKey).String(), *keystoneAddress)
+	}
+
+	if len(*serverGroup) == 0 {
+		*serverGroup = *keystoneAddress
+	}
+
+	// Group updates and proposals are made and voted on by the
+	// Keystone key, as a member of users' groups, which it would not be
+	// if another server group took its place
+	if *serverGroup != *keystoneAddress {
+		log.Fatalf("Server group %s is not supported: the Keystone key %s must itself be the member of users' groups", *serverGroup, *keystoneAddress)
+	}
+
+	cosmosKeyring, err := openCosmosKeyring(*keyringType, *keyringDir, keystore, *pkcs11Config)
+
+	if err != nil {
+		log.Fatalln("Failed to open keyring:", err)
+	}
+
+	// The RPC client, like the gRPC connection, is shared by every
+	// request
+	rpcClient, err := client.NewClientFromNode(*chainRpcURI)
+
+	if err != nil {
+		log.Fatalln("Failed to create chain RPC client:", err)
+	}
+
+	chainConn, err := dialChain(*chainGrpcAddress, chainTLSConfig{
+		Enabled:  *chainGrpcTLS,
+		CAFile:   *chainGrpcCA,
+		CertFile: *chainGrpcCert,
+		KeyFile:  *chainGrpcKey,
+	})
+
+	if err != nil {
+		log.Fatalln("Failed to connect to chain gRPC endpoint:", err)
+	}
+
+	defer chainConn.Close()
+
+	serverOpts := []grpc.ServerOption{}
+
+	creds, err := listenerTLSConfig{
+		CertFile:     *listenTLSCert,
+		KeyFile:      *listenTLSKey,
+		ClientCAFile: *listenClientCA,
+	}.serverCredentials()
+
+	if err != nil {
+		log.Fatalln("Failed to configure listener TLS:", err)
+	}
+
+	if creds != nil {
+		serverOpts = append(serverOpts, creds)
+	} else {
+		log.Println("Listening without TLS: not for production use")
+	}
+
+	nonces, err := openNonceStore(*nonceStoreType, *nonceStoreDir)
+
+	if err != nil {
+		log.Fatalln("Failed to open nonce store:", err)
+	}
+
+	defer nonces.Close()
+
+	interceptors := []grpc.UnaryServerInterceptor{recoverPanics}
+
+	if *requireAuth {
+		auth := &authInterceptor{MaxClockSkew: *authMaxSkew, Nonces: nonces}
+		interceptors = append(interceptors, auth.unary)
+	} else {
+		log.Println("Request authentication is disabled: not for production use")
+	}
+
+	serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(interceptors...))
+
+	registry, err := openRegistry(*registryType, *registryDir)
+
+	if err != nil {
+		log.Fatalln("Failed to open user registry:", err)
+	}
+
+	defer registry.Close()
+
+	stopPruning := make(chan struct{})
+	defer close(stopPruning)
+	go pruneNonces(nonces, *nonceGCInterval, stopPruning)
+
 	lis, err := net.Listen("tcp", ":" + *grpcListenPort)
 
 	if err != nil {
@@ -332,10 +724,31 @@ func main() {
 		KeyringType: *keyringType,
 		KeyringDir: *keyringDir,
 		RpcURI: *chainRpcURI,
+		RpcClient: rpcClient,
+		Keyring: keystore,
+		SigningKey: signingKey,
+		ServerGroup: *serverGroup,
+		CosmosKeyring: cosmosKeyring,
+		ChainConn: chainConn,
+		BroadcastMode: mode,
+		TxTimeout: *txTimeout,
+		GasAdjustment: *gasAdjustment,
+		GasPrices: prices,
+		Sequences: newSequenceManager(),
+		AdminGroupPolicy: adminGroupPolicy,
+		KeyGroupPolicy: keyGroupPolicy,
+		MaxMetadataLen: *maxMetadataLen,
+		RequireAuth: *requireAuth,
+		MaxClockSkew: *authMaxSkew,
+		Nonces: nonces,
+		Registry: registry,
+		UserFunding: funding,
+		Registering: newRegistrationLocks(),
 	}
 	
-	s := grpc.NewServer()
+	s := grpc.NewServer(serverOpts...)
 	keystonepb.RegisterKeystoneServiceServer(s, &ss)
+	keystonepb.RegisterKeyringServer(s, &keyringServer{Keyring: keystore, ServerKeyLabel: *keyLabel, Registry: registry})
 
 	s.Serve(lis)
 	return
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/cosmos-sdk/client"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+
+	"github.com/regen-network/keystone/keys"
+	keystonepb "github.com/regen-network/keystone/keystoned/proto"
+)
+
+func TestChainClientReusesRpcClient(t *testing.T) {
+	key, err := keys.NewInMemoryKeyring().NewKey(keys.KEYGEN_SECP256K1, "keystone")
+	require.NoError(t, err)
+
+	// No connection is made until the client is used
+	rpcClient, err := client.NewClientFromNode("tcp://localhost:26657")
+	require.NoError(t, err)
+
+	s := &server{ServerAddress: keyAddress(key).String(), ChainID: "test-chain", RpcClient: rpcClient, Sequences: newSequenceManager()}
+
+	first, err := s.chainClient()
+	require.NoError(t, err)
+
+	second, err := s.chainClient()
+	require.NoError(t, err)
+
+	require.True(t, first.Context.Client == rpcClient)
+	require.True(t, second.Context.Client == rpcClient)
+}
+
+func TestUserKeyReused(t *testing.T) {
+	s := &server{Keyring: keys.NewInMemoryKeyring()}
+
+	key, err := s.userKey("regen1device")
+	require.NoError(t, err)
+	require.Equal(t, USER_KEY_LABEL_PREFIX+"regen1device", key.Label)
+
+	// A retry by the same device gets the same key, and another device
+	// a new one
+	again, err := s.userKey("regen1device")
+	require.NoError(t, err)
+	require.True(t, key.PubKey().Equals(again.PubKey()))
+
+	other, err := s.userKey("regen1other")
+	require.NoError(t, err)
+	require.False(t, key.PubKey().Equals(other.PubKey()))
+}
+
+func TestFundingShortfall(t *testing.T) {
+	funding := sdk.NewCoins(sdk.NewInt64Coin("uatom", 10), sdk.NewInt64Coin("uregen", 100))
+
+	tests := []struct {
+		name      string
+		balance   sdk.Coins
+		shortfall sdk.Coins
+	}{
+		{"new account", nil, funding},
+		{"partly funded", sdk.NewCoins(sdk.NewInt64Coin("uregen", 40)), sdk.NewCoins(sdk.NewInt64Coin("uatom", 10), sdk.NewInt64Coin("uregen", 60))},
+		{"funded", funding, sdk.Coins{}},
+		{"more than funded", sdk.NewCoins(sdk.NewInt64Coin("uatom", 50), sdk.NewInt64Coin("uregen", 500)), sdk.Coins{}},
+		{"other denoms", sdk.NewCoins(sdk.NewInt64Coin("ufoo", 100)), funding},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			shortfall := fundingShortfall(funding, tc.balance)
+			require.NoError(t, shortfall.Validate())
+			require.True(t, tc.shortfall.IsEqual(shortfall), "shortfall %s, expected %s", shortfall, tc.shortfall)
+		})
+	}
+}
+
+func TestRegisterFundingRequiresClientCert(t *testing.T) {
+	s := &server{
+		Keyring:     keys.NewInMemoryKeyring(),
+		Registry:    &dbRegistry{db: dbm.NewMemDB()},
+		Registering: newRegistrationLocks(),
+		UserFunding: sdk.NewCoins(sdk.NewInt64Coin("uregen", 100)),
+	}
+
+	// A device envelope alone is not enough for a funded registration,
+	// and no key is created for the device
+	device := secp256k1.GenPrivKey()
+	res, err := s.Register(callerContext(device), &keystonepb.RegisterRequest{})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_UNAUTHORIZED, res.Status)
+
+	_, err = s.Keyring.Key(USER_KEY_LABEL_PREFIX + sdk.AccAddress(device.PubKey().Address()).String())
+	require.Equal(t, keys.ErrKeyNotFound, err)
+
+	// Nor is a keyless registration possible without a device
+	res, err = s.Register(verifiedCertContext(), &keystonepb.RegisterRequest{})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_UNAUTHORIZED, res.Status)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/regen-network/regen-ledger/x/group"
+
+	keystonepb "github.com/regen-network/keystone/keystoned/proto"
+)
+
+// UpdateMembers implements the method given in the protobuf
+// definition for the Keystone service (proto/keystone.proto). It adds,
+// removes (with a weight of "0") or reweights members of a group, such
+// as a user's key group when a device is added or lost.
+func (s *server) UpdateMembers(ctx context.Context, in *keystonepb.UpdateMembersRequest) (*keystonepb.GroupUpdateResponse, error) {
+	log.Printf("Update members request for group: %d", in.GroupId)
+
+	if in.GroupId == 0 || !validAddress(in.AdminAddress) || len(in.Members) == 0 {
+		return &keystonepb.GroupUpdateResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
+
+	members := make([]group.Member, 0, len(in.Members))
+
+	for _, m := range in.Members {
+		if !validAddress(m.Address) || len(m.Weight) == 0 {
+			return &keystonepb.GroupUpdateResponse{Status: STATUS_BAD_REQUEST}, nil
+		}
+
+		members = append(members, group.Member{Address: m.Address, Weight: m.Weight, Metadata: m.Metadata})
+	}
+
+	return s.updateGroup(ctx, in.AdminAddress, &group.MsgUpdateGroupMembers{
+		Admin:         in.AdminAddress,
+		GroupId:       in.GroupId,
+		MemberUpdates: members,
+	})
+}
+
+// UpdateAdmin implements the method given in the protobuf definition
+// for the Keystone service (proto/keystone.proto). It hands the
+// administration of a group to a new admin.
+func (s *server) UpdateAdmin(ctx context.Context, in *keystonepb.UpdateAdminRequest) (*keystonepb.GroupUpdateResponse, error) {
+	log.Printf("Update admin request for group: %d", in.GroupId)
+
+	if in.GroupId == 0 || !validAddress(in.AdminAddress) || !validAddress(in.NewAdmin) {
+		return &keystonepb.GroupUpdateResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
+
+	return s.updateGroup(ctx, in.AdminAddress, &group.MsgUpdateGroupAdmin{
+		Admin:    in.AdminAddress,
+		GroupId:  in.GroupId,
+		NewAdmin: in.NewAdmin,
+	})
+}
+
+// UpdateMetadata implements the method given in the protobuf
+// definition for the Keystone service (proto/keystone.proto). It
+// replaces the metadata of a group.
+func (s *server) UpdateMetadata(ctx context.Context, in *keystonepb.UpdateMetadataRequest) (*keystonepb.GroupUpdateResponse, error) {
+	log.Printf("Update metadata request for group: %d", in.GroupId)
+
+	if in.GroupId == 0 || !validAddress(in.AdminAddress) {
+		return &keystonepb.GroupUpdateResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
+
+	return s.updateGroup(ctx, in.AdminAddress, &group.MsgUpdateGroupMetadata{
+		Admin:    in.AdminAddress,
+		GroupId:  in.GroupId,
+		Metadata: in.Metadata,
+	})
+}
+
+// UpdateDecisionPolicy implements the method given in the protobuf
+// definition for the Keystone service (proto/keystone.proto). It
+// replaces the decision policy of a group account, for example to
+// require two of a user's three devices to approve transactions from
+// their key group.
+func (s *server) UpdateDecisionPolicy(ctx context.Context, in *keystonepb.UpdateDecisionPolicyRequest) (*keystonepb.GroupUpdateResponse, error) {
+	log.Printf("Update decision policy request for group account: %s", in.GroupAccountAddress)
+
+	if !validAddress(in.GroupAccountAddress) || !validAddress(in.AdminAddress) || in.Policy == nil {
+		return &keystonepb.GroupUpdateResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
+
+	policy := policyFromProto(in.Policy)
+
+	// The total weight of the group is checked by the chain
+	if err := policy.validate(nil); err != nil {
+		log.Printf("Invalid decision policy: %s", err.Error())
+		return &keystonepb.GroupUpdateResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
+
+	admin, _ := sdk.AccAddressFromBech32(in.AdminAddress)
+	account, _ := sdk.AccAddressFromBech32(in.GroupAccountAddress)
+
+	msg, err := group.NewMsgUpdateGroupAccountDecisionPolicyRequest(admin, account, policy.decisionPolicy())
+
+	if err != nil {
+		log.Printf("Error building decision policy message: %s", err.Error())
+		return &keystonepb.GroupUpdateResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
+
+	return s.updateGroup(ctx, in.AdminAddress, msg)
+}
+
+// policyFromProto returns the threshold policy given in a Keystone
+// service request.
+func policyFromProto(policy *keystonepb.DecisionPolicy) thresholdPolicy {
+	return thresholdPolicy{
+		Threshold: policy.Threshold,
+		Timeout:   time.Duration(policy.TimeoutSeconds) * time.Second,
+	}
+}
+
+// updateGroup executes a group update message on behalf of the
+// group admin, signed by the Keystone server key, and reports the
+// outcome. The caller must be a member of the admin group, and the
+// Keystone key must be able to act for the admin (see
+// requireKeystoneMember).
+func (s *server) updateGroup(ctx context.Context, admin string, msg sdk.Msg) (*keystonepb.GroupUpdateResponse, error) {
+
+	err := s.authorizeAccount(ctx, admin)
+
+	if err != nil {
+		log.Printf("Unauthorized group update: %s", err.Error())
+		return &keystonepb.GroupUpdateResponse{Status: STATUS_UNAUTHORIZED}, nil
+	}
+
+	err = s.requireKeystoneMember(admin)
+
+	if err != nil {
+		log.Printf("Cannot update group: %s", err.Error())
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	chain, err := s.chainClient()
+
+	if err != nil {
+		log.Printf("Error getting local node context: %s", err.Error())
+		return nil, err
+	}
+
+	proposalID, executed, err := execAsAdmin(s.SigningKey, admin, msg, chain)
+
+	if err != nil {
+		log.Printf("Error updating group: %s", err.Error())
+		return &keystonepb.GroupUpdateResponse{Status: STATUS_TX_FAILED, Transactions: txResults(chain.Results)}, nil
+	}
+
+	return &keystonepb.GroupUpdateResponse{
+		Status:       STATUS_OK,
+		ProposalId:   proposalID,
+		Executed:     executed,
+		Transactions: txResults(chain.Results),
+	}, nil
+}
+
+// requireKeystoneMember checks that the Keystone key can act for the
+// given account: either the account is the Keystone address, or it is
+// a group account of a group which the Keystone key is a member of, so
+// that it can make and vote on proposals to the group.
+func (s *server) requireKeystoneMember(account string) error {
+
+	keystoneAddr := keyAddress(s.SigningKey).String()
+
+	if account == keystoneAddr {
+		return nil
+	}
+
+	groupID, err := groupAccountGroup(s.ChainConn, account)
+
+	if err != nil {
+		return fmt.Errorf("%s is not a group account: %s", account, err.Error())
+	}
+
+	member, err := s.isGroupMember(groupID, keystoneAddr)
+
+	if err != nil {
+		return err
+	}
+
+	if !member {
+		return fmt.Errorf("the Keystone key %s is not a member of group %d, so cannot propose or vote for %s", keystoneAddr, groupID, account)
+	}
+
+	return nil
+}
+
+// validAddress returns true if the given string is a valid bech32
+// account address.
+func validAddress(address string) bool {
+	_, err := sdk.AccAddressFromBech32(address)
+	return err == nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	keystonepb "github.com/regen-network/keystone/keystoned/proto"
+)
+
+// MAX_METADATA_LEN is the default maximum length, in bytes, of group
+// and member metadata accepted by the group module of the chain.
+const MAX_METADATA_LEN = 255
+
+// groupMetadata is the metadata attached to the groups created for a
+// user by Register, so that apps can show the user meaningful names
+// for their keys.
+type groupMetadata struct {
+	DisplayName   string   `json:"display_name,omitempty"`
+	RecoveryHints []string `json:"recovery_hints,omitempty"`
+}
+
+// memberMetadata is the metadata attached to the user's membership of
+// their groups, describing the device holding their key.
+type memberMetadata struct {
+	Description string `json:"description,omitempty"`
+}
+
+// registerMetadata encodes the metadata given in a register request
+// for the user's groups and for the user as a group member. Either is
+// nil if there is nothing to attach. An error is returned if either
+// would be longer than maxLen bytes, and so rejected by the chain.
+func registerMetadata(in *keystonepb.RegisterMetadata, maxLen int) ([]byte, []byte, error) {
+
+	if in == nil {
+		return nil, nil, nil
+	}
+
+	groupMeta, err := encodeMetadata(groupMetadata{DisplayName: in.DisplayName, RecoveryHints: in.RecoveryHints}, maxLen)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("group metadata: %s", err.Error())
+	}
+
+	memberMeta, err := encodeMetadata(memberMetadata{Description: in.DeviceDescription}, maxLen)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("member metadata: %s", err.Error())
+	}
+
+	return groupMeta, memberMeta, nil
+}
+
+// encodeMetadata returns the JSON encoding of the given metadata, or
+// nil if it has no fields set.
+func encodeMetadata(v interface{}, maxLen int) ([]byte, error) {
+
+	bz, err := json.Marshal(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if string(bz) == "{}" {
+		return nil, nil
+	}
+
+	if len(bz) > maxLen {
+		return nil, fmt.Errorf("%d bytes is more than the maximum of %d", len(bz), maxLen)
+	}
+
+	return bz, nil
+}
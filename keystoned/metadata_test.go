@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	keystonepb "github.com/regen-network/keystone/keystoned/proto"
+)
+
+func TestRegisterMetadata(t *testing.T) {
+	groupMeta, memberMeta, err := registerMetadata(nil, MAX_METADATA_LEN)
+	require.NoError(t, err)
+	require.Nil(t, groupMeta)
+	require.Nil(t, memberMeta)
+
+	// Nothing is attached if no fields are set
+	groupMeta, memberMeta, err = registerMetadata(&keystonepb.RegisterMetadata{}, MAX_METADATA_LEN)
+	require.NoError(t, err)
+	require.Nil(t, groupMeta)
+	require.Nil(t, memberMeta)
+
+	groupMeta, memberMeta, err = registerMetadata(&keystonepb.RegisterMetadata{
+		DisplayName:       "Alice",
+		DeviceDescription: "Phone",
+		RecoveryHints:     []string{"laptop"},
+	}, MAX_METADATA_LEN)
+	require.NoError(t, err)
+	require.Equal(t, `{"display_name":"Alice","recovery_hints":["laptop"]}`, string(groupMeta))
+	require.Equal(t, `{"description":"Phone"}`, string(memberMeta))
+
+	groupMeta, memberMeta, err = registerMetadata(&keystonepb.RegisterMetadata{DeviceDescription: "Phone"}, MAX_METADATA_LEN)
+	require.NoError(t, err)
+	require.Nil(t, groupMeta)
+	require.Equal(t, `{"description":"Phone"}`, string(memberMeta))
+}
+
+func TestRegisterMetadataTooLong(t *testing.T) {
+	long := strings.Repeat("a", MAX_METADATA_LEN)
+
+	_, _, err := registerMetadata(&keystonepb.RegisterMetadata{DisplayName: long}, MAX_METADATA_LEN)
+	require.Error(t, err)
+
+	_, _, err = registerMetadata(&keystonepb.RegisterMetadata{DeviceDescription: long}, MAX_METADATA_LEN)
+	require.Error(t, err)
+
+	// The limit applies to the encoded metadata
+	encoded, err := encodeMetadata(memberMetadata{Description: "Phone"}, len(`{"description":"Phone"}`))
+	require.NoError(t, err)
+	require.NotNil(t, encoded)
+
+	_, err = encodeMetadata(memberMetadata{Description: "Phone"}, len(`{"description":"Phone"}`)-1)
+	require.Error(t, err)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// NONCE_GC_INTERVAL is the default interval between removals of
+// expired nonces from the nonce store.
+const NONCE_GC_INTERVAL = 10 * time.Minute
+
+// errNonceUsed is returned when a nonce has already been used in the
+// same scope.
+var errNonceUsed = errors.New("nonce has already been used")
+
+// nonceStore records the nonces of device-signed requests, so that a
+// captured request cannot be replayed. Nonces are recorded in a scope:
+// the user key, for sign requests, and the device, for request
+// envelopes. A nonce only needs to be kept until its expiry: after
+// that, the timestamp signed with it is too old for the request to be
+// accepted anyway.
+type nonceStore interface {
+	// Use records the nonce of a request in the given scope, which
+	// expires at the given time. errNonceUsed is returned if the nonce
+	// has already been used in the scope, and it has not expired.
+	Use(scope string, nonce []byte, expiry time.Time) error
+
+	// Prune removes the nonces which expired before the given time,
+	// returning how many were removed.
+	Prune(now time.Time) (int, error)
+
+	Close() error
+}
+
+// dbNonceStore is a nonceStore held in an embedded key-value
+// database: goleveldb on disk, or in memory for testing. The key of
+// each nonce is its scope and the nonce, and its value is the expiry
+// time.
+type dbNonceStore struct {
+	mtx sync.Mutex
+	db  dbm.DB
+}
+
+var _ nonceStore = &dbNonceStore{}
+
+// openNonceStore opens the nonce store of the given type: leveldb,
+// in the given directory, or memory.
+func openNonceStore(storeType string, dir string) (nonceStore, error) {
+	switch storeType {
+	case "leveldb":
+		db, err := dbm.NewGoLevelDB("nonces", dir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &dbNonceStore{db: db}, nil
+	case "memory":
+		log.Println("Using in-memory nonce store: sign requests may be replayed after a restart")
+		return &dbNonceStore{db: dbm.NewMemDB()}, nil
+	default:
+		return nil, fmt.Errorf("unknown nonce store type: %s", storeType)
+	}
+}
+
+func (s *dbNonceStore) Use(scope string, nonce []byte, expiry time.Time) error {
+
+	key := nonceKey(scope, nonce)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	value, err := s.db.Get(key)
+
+	if err != nil {
+		return err
+	}
+
+	if value != nil && time.Now().Before(decodeExpiry(value)) {
+		return errNonceUsed
+	}
+
+	// The write is synced, so that a nonce is never forgotten by a
+	// crash after the request has been accepted
+	return s.db.SetSync(key, encodeExpiry(expiry))
+}
+
+func (s *dbNonceStore) Prune(now time.Time) (int, error) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	it, err := s.db.Iterator(nil, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	expired := [][]byte{}
+
+	for ; it.Valid(); it.Next() {
+		if decodeExpiry(it.Value()).Before(now) {
+			expired = append(expired, it.Key())
+		}
+	}
+
+	err = it.Error()
+	it.Close()
+
+	if err != nil {
+		return 0, err
+	}
+
+	batch := s.db.NewBatch()
+	defer batch.Close()
+
+	for _, key := range expired {
+		if err := batch.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := batch.WriteSync(); err != nil {
+		return 0, err
+	}
+
+	return len(expired), nil
+}
+
+func (s *dbNonceStore) Close() error {
+	return s.db.Close()
+}
+
+// pruneNonces removes expired nonces from the store at the given
+// interval, until the done channel is closed.
+func pruneNonces(store nonceStore, interval time.Duration, done <-chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n, err := store.Prune(time.Now())
+
+			if err != nil {
+				log.Printf("Error pruning nonce store: %s", err.Error())
+				continue
+			}
+
+			if n > 0 {
+				log.Printf("Pruned %d expired nonces", n)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// nonceKey is the key of a nonce in the store: the scope, prefixed
+// with its length (as a uvarint), followed by the nonce.
+func nonceKey(scope string, nonce []byte) []byte {
+	key := make([]byte, binary.MaxVarintLen64)
+	key = key[:binary.PutUvarint(key, uint64(len(scope)))]
+	key = append(key, scope...)
+	return append(key, nonce...)
+}
+
+func encodeExpiry(expiry time.Time) []byte {
+	bz := make([]byte, 8)
+	binary.BigEndian.PutUint64(bz, uint64(expiry.UnixNano()))
+	return bz
+}
+
+func decodeExpiry(bz []byte) time.Time {
+	if len(bz) != 8 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(binary.BigEndian.Uint64(bz)))
+}
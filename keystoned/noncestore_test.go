@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+)
+
+func TestNonceReuseRejected(t *testing.T) {
+	store := &dbNonceStore{db: dbm.NewMemDB()}
+	expiry := time.Now().Add(time.Minute)
+
+	require.NoError(t, store.Use("device1", []byte("nonce"), expiry))
+	require.Equal(t, errNonceUsed, store.Use("device1", []byte("nonce"), expiry))
+
+	// The same nonce may be used by another device, or a new nonce by
+	// the same device
+	require.NoError(t, store.Use("device2", []byte("nonce"), expiry))
+	require.NoError(t, store.Use("device1", []byte("nonce2"), expiry))
+}
+
+func TestNonceExpiredReusable(t *testing.T) {
+	store := &dbNonceStore{db: dbm.NewMemDB()}
+
+	require.NoError(t, store.Use("device", []byte("nonce"), time.Now().Add(-time.Second)))
+	require.NoError(t, store.Use("device", []byte("nonce"), time.Now().Add(time.Minute)))
+	require.Equal(t, errNonceUsed, store.Use("device", []byte("nonce"), time.Now().Add(time.Minute)))
+}
+
+func TestNoncePrune(t *testing.T) {
+	store := &dbNonceStore{db: dbm.NewMemDB()}
+	now := time.Now()
+
+	require.NoError(t, store.Use("device", []byte("expired1"), now.Add(-time.Minute)))
+	require.NoError(t, store.Use("device", []byte("expired2"), now.Add(-time.Second)))
+	require.NoError(t, store.Use("device", []byte("live"), now.Add(time.Minute)))
+
+	n, err := store.Prune(now)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// The unexpired nonce is still recorded
+	require.Equal(t, errNonceUsed, store.Use("device", []byte("live"), now.Add(time.Minute)))
+
+	n, err = store.Prune(now)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestNonceKeyDevices(t *testing.T) {
+	require.NotEqual(t, nonceKey("ab", []byte("c")), nonceKey("a", []byte("bc")))
+	require.NotEqual(t, nonceKey("", []byte("\x01a")), nonceKey("a", nil))
+
+	store := &dbNonceStore{db: dbm.NewMemDB()}
+	expiry := time.Now().Add(time.Minute)
+
+	require.NoError(t, store.Use("ab", []byte("c"), expiry))
+	require.NoError(t, store.Use("a", []byte("bc"), expiry))
+
+	// Scopes longer than a one-byte length prefix could hold
+	long := strings.Repeat("a", 256)
+	require.NotEqual(t, nonceKey(long, []byte("c")), nonceKey("", append([]byte(long), 'c')))
+	require.NoError(t, store.Use(long, []byte("c"), expiry))
+	require.NoError(t, store.Use("", append([]byte(long), 'c'), expiry))
+}
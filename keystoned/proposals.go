@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	codectypes "github.com/cosmos/cosmos-sdk/codec/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/regen-network/regen-ledger/x/group"
+
+	"github.com/regen-network/keystone/keys"
+	keystonepb "github.com/regen-network/keystone/keystoned/proto"
+)
+
+// CreateProposal implements the method given in the protobuf
+// definition for the Keystone service (proto/keystone.proto). The
+// user's messages are proposed to the group of the given group
+// account by the Keystone server, which then votes yes. If that vote
+// is enough to pass the proposal, it is executed straight away;
+// otherwise it waits for votes from the user's devices.
+//
+// The Keystone server key must be a member of the group, or the
+// request fails with FailedPrecondition.
+func (s *server) CreateProposal(ctx context.Context, in *keystonepb.CreateProposalRequest) (*keystonepb.ProposalResponse, error) {
+	log.Printf("Create proposal request for group account: %s", in.GroupAccountAddress)
+
+	if !validAddress(in.GroupAccountAddress) || len(in.Msgs) == 0 {
+		return &keystonepb.ProposalResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
+
+	err := s.authorizeAccount(ctx, in.GroupAccountAddress)
+
+	if err != nil {
+		log.Printf("Unauthorized proposal: %s", err.Error())
+		return &keystonepb.ProposalResponse{Status: STATUS_UNAUTHORIZED}, nil
+	}
+
+	msgs, err := unpackMsgs(in.Msgs, in.GroupAccountAddress)
+
+	if err != nil {
+		log.Printf("Invalid proposal messages: %s", err.Error())
+		return &keystonepb.ProposalResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
+
+	err = s.requireKeystoneMember(in.GroupAccountAddress)
+
+	if err != nil {
+		log.Printf("Cannot create proposal: %s", err.Error())
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	chain, err := s.chainClient()
+
+	if err != nil {
+		log.Printf("Error getting local node context: %s", err.Error())
+		return nil, err
+	}
+
+	proposalID, err := createProposal(s.SigningKey, in.GroupAccountAddress, msgs, in.Metadata, chain)
+
+	if err != nil {
+		return &keystonepb.ProposalResponse{Status: STATUS_TX_FAILED, Transactions: txResults(chain.Results)}, nil
+	}
+
+	_, err = vote(s.SigningKey, proposalID, group.Choice_CHOICE_YES, nil, chain)
+
+	if err != nil {
+		return &keystonepb.ProposalResponse{Status: STATUS_TX_FAILED, ProposalId: proposalID, Transactions: txResults(chain.Results)}, nil
+	}
+
+	return s.proposalResponse(proposalID, chain.Results)
+}
+
+// Vote implements the method given in the protobuf definition for the
+// Keystone service (proto/keystone.proto), casting the Keystone
+// server's vote on a proposal. A yes vote which passes the proposal
+// also executes it. As for CreateProposal, the Keystone server key
+// must be a member of the group.
+func (s *server) Vote(ctx context.Context, in *keystonepb.VoteRequest) (*keystonepb.ProposalResponse, error) {
+	log.Printf("Vote request for proposal: %d", in.ProposalId)
+
+	if in.ProposalId == 0 || in.Choice == keystonepb.VoteChoice_CHOICE_UNSPECIFIED {
+		return &keystonepb.ProposalResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
+
+	err := s.authorizeProposal(ctx, in.ProposalId)
+
+	if err != nil {
+		log.Printf("Unauthorized vote: %s", err.Error())
+		return &keystonepb.ProposalResponse{Status: STATUS_UNAUTHORIZED}, nil
+	}
+
+	proposal, err := queryProposal(s.ChainConn, in.ProposalId)
+
+	if err != nil {
+		log.Printf("Error querying proposal %d: %s", in.ProposalId, err.Error())
+		return nil, err
+	}
+
+	err = s.requireKeystoneMember(proposal.Address)
+
+	if err != nil {
+		log.Printf("Cannot vote: %s", err.Error())
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	chain, err := s.chainClient()
+
+	if err != nil {
+		log.Printf("Error getting local node context: %s", err.Error())
+		return nil, err
+	}
+
+	_, err = vote(s.SigningKey, in.ProposalId, group.Choice(in.Choice), in.Metadata, chain)
+
+	if err != nil {
+		return &keystonepb.ProposalResponse{Status: STATUS_TX_FAILED, ProposalId: in.ProposalId, Transactions: txResults(chain.Results)}, nil
+	}
+
+	return s.proposalResponse(in.ProposalId, chain.Results)
+}
+
+// ProposalStatus implements the method given in the protobuf
+// definition for the Keystone service (proto/keystone.proto),
+// reporting the status and tally of a proposal.
+func (s *server) ProposalStatus(ctx context.Context, in *keystonepb.ProposalStatusRequest) (*keystonepb.ProposalResponse, error) {
+
+	if in.ProposalId == 0 {
+		return &keystonepb.ProposalResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
+
+	err := s.authorizeProposal(ctx, in.ProposalId)
+
+	if err != nil {
+		log.Printf("Unauthorized proposal status request: %s", err.Error())
+		return &keystonepb.ProposalResponse{Status: STATUS_UNAUTHORIZED}, nil
+	}
+
+	return s.proposalResponse(in.ProposalId, nil)
+}
+
+// Exec implements the method given in the protobuf definition for the
+// Keystone service (proto/keystone.proto), executing a proposal which
+// has passed, signed by the Keystone server key. Any account may
+// execute a proposal, so the key need not be a member of the group.
+func (s *server) Exec(ctx context.Context, in *keystonepb.ExecRequest) (*keystonepb.ProposalResponse, error) {
+	log.Printf("Exec request for proposal: %d", in.ProposalId)
+
+	if in.ProposalId == 0 {
+		return &keystonepb.ProposalResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
+
+	err := s.authorizeProposal(ctx, in.ProposalId)
+
+	if err != nil {
+		log.Printf("Unauthorized exec: %s", err.Error())
+		return &keystonepb.ProposalResponse{Status: STATUS_UNAUTHORIZED}, nil
+	}
+
+	chain, err := s.chainClient()
+
+	if err != nil {
+		log.Printf("Error getting local node context: %s", err.Error())
+		return nil, err
+	}
+
+	err = execProposal(s.SigningKey, in.ProposalId, chain)
+
+	if err != nil {
+		return &keystonepb.ProposalResponse{Status: STATUS_TX_FAILED, ProposalId: in.ProposalId, Transactions: txResults(chain.Results)}, nil
+	}
+
+	return s.proposalResponse(in.ProposalId, chain.Results)
+}
+
+// proposalResponse queries the chain for the current state of a
+// proposal, and reports it with the given transaction results.
+func (s *server) proposalResponse(proposalID uint64, results []*sdk.TxResponse) (*keystonepb.ProposalResponse, error) {
+
+	proposal, err := queryProposal(s.ChainConn, proposalID)
+
+	if err != nil {
+		log.Printf("Error querying proposal %d: %s", proposalID, err.Error())
+		return nil, err
+	}
+
+	return &keystonepb.ProposalResponse{
+		Status:         STATUS_OK,
+		ProposalId:     proposalID,
+		ProposalStatus: proposal.Status.String(),
+		Result:         proposal.Result.String(),
+		ExecutorResult: proposal.ExecutorResult.String(),
+		YesCount:       proposal.VoteState.YesCount,
+		NoCount:        proposal.VoteState.NoCount,
+		AbstainCount:   proposal.VoteState.AbstainCount,
+		VetoCount:      proposal.VoteState.VetoCount,
+		Transactions:   txResults(results),
+	}, nil
+}
+
+// unpackMsgs unpacks the Cosmos SDK messages of a proposal, checking
+// that each is to be signed by the group account alone, as the group
+// module requires.
+func unpackMsgs(anys []*anypb.Any, groupAccount string) ([]sdk.Msg, error) {
+
+	registry := makeEncodingConfig().InterfaceRegistry
+	msgs := make([]sdk.Msg, 0, len(anys))
+
+	for _, a := range anys {
+		var msg sdk.Msg
+
+		err := registry.UnpackAny(&codectypes.Any{TypeUrl: a.TypeUrl, Value: a.Value}, &msg)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = msg.ValidateBasic()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, signer := range msg.GetSigners() {
+			if signer.String() != groupAccount {
+				return nil, fmt.Errorf("message %s must be signed by %s, not %s", a.TypeUrl, groupAccount, signer.String())
+			}
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// createProposal proposes the given messages to the group of a group
+// account, with the given Keystone key as the proposer. The ID of the
+// new proposal is returned.
+func createProposal(signer *keys.CryptoKey, groupAccount string, msgs []sdk.Msg, metadata []byte, chain *chainClient) (uint64, error) {
+
+	msg, err := group.NewMsgCreateProposalRequest(groupAccount, []string{keyAddress(signer).String()}, msgs, metadata, group.Exec_EXEC_UNSPECIFIED)
+
+	if err != nil {
+		log.Printf("Error building proposal: %s", err.Error())
+		return 0, err
+	}
+
+	res, err := chain.sendTx(&txRequest{Signer: signer, Msgs: []sdk.Msg{msg}})
+
+	if err != nil {
+		log.Printf("Error creating proposal: %s", err.Error())
+		return 0, err
+	}
+
+	var created group.MsgCreateProposalResponse
+
+	err = msgResult(res, 0, &created)
+
+	if err != nil {
+		log.Printf("Error decoding proposal creation result: %s", err.Error())
+		return 0, err
+	}
+
+	log.Printf("Proposal created: %d", created.ProposalId)
+
+	return created.ProposalId, nil
+}
+
+// vote casts the vote of the given Keystone key on a proposal. A yes
+// vote also tries to execute the proposal, which succeeds if the vote
+// passes it. Whether the proposal was executed is returned.
+func vote(signer *keys.CryptoKey, proposalID uint64, choice group.Choice, metadata []byte, chain *chainClient) (bool, error) {
+
+	exec := group.Exec_EXEC_UNSPECIFIED
+
+	if choice == group.Choice_CHOICE_YES {
+		exec = group.Exec_EXEC_TRY
+	}
+
+	res, err := chain.sendTx(&txRequest{Signer: signer, Msgs: []sdk.Msg{&group.MsgVote{
+		ProposalId: proposalID,
+		Voter:      keyAddress(signer).String(),
+		Choice:     choice,
+		Metadata:   metadata,
+		Exec:       exec,
+	}}})
+
+	if err != nil {
+		log.Printf("Error voting on proposal %d: %s", proposalID, err.Error())
+		return false, err
+	}
+
+	executed := proposalExecuted(res, 0, proposalID)
+	log.Printf("Voted %s on proposal %d, executed: %v", choice.String(), proposalID, executed)
+
+	return executed, nil
+}
+
+// execProposal executes a proposal which has passed, signed by the
+// given Keystone key.
+func execProposal(signer *keys.CryptoKey, proposalID uint64, chain *chainClient) error {
+
+	_, err := chain.sendTx(&txRequest{Signer: signer, Msgs: []sdk.Msg{&group.MsgExec{
+		ProposalId: proposalID,
+		Signer:     keyAddress(signer).String(),
+	}}})
+
+	if err != nil {
+		log.Printf("Error executing proposal %d: %s", proposalID, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// queryProposal returns the proposal with the given ID from the chain.
+func queryProposal(grpcConn *grpc.ClientConn, proposalID uint64) (*group.Proposal, error) {
+
+	res, err := group.NewQueryClient(grpcConn).Proposal(context.Background(), &group.QueryProposalRequest{ProposalId: proposalID})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Proposal, nil
+}
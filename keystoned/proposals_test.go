@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	codectypes "github.com/cosmos/cosmos-sdk/codec/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	banktypes "github.com/cosmos/cosmos-sdk/x/bank/types"
+
+	"github.com/regen-network/keystone/keys"
+	keystonepb "github.com/regen-network/keystone/keystoned/proto"
+)
+
+// testAddress returns the address of a new software key.
+func testAddress(t *testing.T) sdk.AccAddress {
+	key, err := keys.NewInMemoryKeyring().NewKey(keys.KEYGEN_SECP256K1, "test")
+	require.NoError(t, err)
+
+	return keyAddress(key)
+}
+
+// packMsg returns the message packed as a proposal message.
+func packMsg(t *testing.T, msg sdk.Msg) *anypb.Any {
+	packed, err := codectypes.NewAnyWithValue(msg)
+	require.NoError(t, err)
+
+	return &anypb.Any{TypeUrl: packed.TypeUrl, Value: packed.Value}
+}
+
+func TestUnpackMsgs(t *testing.T) {
+	account := testAddress(t)
+	other := testAddress(t)
+	coins := sdk.NewCoins(sdk.NewInt64Coin("uregen", 10))
+
+	send := banktypes.NewMsgSend(account, other, coins)
+	msgs, err := unpackMsgs([]*anypb.Any{packMsg(t, send), packMsg(t, send)}, account.String())
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, send, msgs[0])
+
+	// Every message must be signed by the group account alone
+	_, err = unpackMsgs([]*anypb.Any{packMsg(t, send), packMsg(t, banktypes.NewMsgSend(other, account, coins))}, account.String())
+	require.Error(t, err)
+
+	// Messages must be valid
+	_, err = unpackMsgs([]*anypb.Any{packMsg(t, banktypes.NewMsgSend(account, other, sdk.Coins{}))}, account.String())
+	require.Error(t, err)
+
+	// and of a known type
+	_, err = unpackMsgs([]*anypb.Any{{TypeUrl: "/cosmos.unknown.v1.MsgUnknown", Value: []byte{}}}, account.String())
+	require.Error(t, err)
+
+	_, err = unpackMsgs([]*anypb.Any{{TypeUrl: packMsg(t, send).TypeUrl, Value: []byte{0xff}}}, account.String())
+	require.Error(t, err)
+}
+
+func TestProposalRequestValidation(t *testing.T) {
+	s := &server{}
+	ctx := context.Background()
+	account := testAddress(t)
+	send := banktypes.NewMsgSend(account, testAddress(t), sdk.NewCoins(sdk.NewInt64Coin("uregen", 10)))
+
+	res, err := s.CreateProposal(ctx, &keystonepb.CreateProposalRequest{GroupAccountAddress: "not an address", Msgs: []*anypb.Any{packMsg(t, send)}})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_BAD_REQUEST, res.Status)
+
+	res, err = s.CreateProposal(ctx, &keystonepb.CreateProposalRequest{GroupAccountAddress: account.String()})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_BAD_REQUEST, res.Status)
+
+	// Messages not from the group account are rejected before the
+	// chain is used
+	res, err = s.CreateProposal(ctx, &keystonepb.CreateProposalRequest{GroupAccountAddress: testAddress(t).String(), Msgs: []*anypb.Any{packMsg(t, send)}})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_BAD_REQUEST, res.Status)
+
+	res, err = s.Vote(ctx, &keystonepb.VoteRequest{Choice: keystonepb.VoteChoice_CHOICE_YES})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_BAD_REQUEST, res.Status)
+
+	res, err = s.Vote(ctx, &keystonepb.VoteRequest{ProposalId: 1})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_BAD_REQUEST, res.Status)
+
+	res, err = s.ProposalStatus(ctx, &keystonepb.ProposalStatusRequest{})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_BAD_REQUEST, res.Status)
+
+	res, err = s.Exec(ctx, &keystonepb.ExecRequest{})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_BAD_REQUEST, res.Status)
+}
+
+func TestRequireKeystoneMember(t *testing.T) {
+	key, err := keys.NewInMemoryKeyring().NewKey(keys.KEYGEN_SECP256K1, "keystone")
+	require.NoError(t, err)
+
+	// The Keystone key can always act for its own address, without
+	// querying the chain
+	s := &server{SigningKey: key}
+	require.NoError(t, s.requireKeystoneMember(keyAddress(key).String()))
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	dbm "github.com/tendermint/tm-db"
+	"google.golang.org/protobuf/proto"
+
+	keystonepb "github.com/regen-network/keystone/keystoned/proto"
+)
+
+// errNotRegistered is returned when there is no registration for a
+// user address, group or key label.
+var errNotRegistered = errors.New("no registration found")
+
+// errAlreadyRegistered is returned when a user address is registered
+// more than once.
+var errAlreadyRegistered = errors.New("address is already registered")
+
+// errDeviceRegistered is returned when a device registers more than
+// one user.
+var errDeviceRegistered = errors.New("device has already registered a user")
+
+// userRegistry records the registration of each user: their address,
+// the label of their key in the Keystone keystore (if Keystone holds
+// it), the device which registered them, and their admin and key
+// groups. Registrations can be looked up by any of the user address,
+// either group ID, the key label, or the registering device.
+type userRegistry interface {
+	Put(reg *keystonepb.Registration) error
+	ByAddress(address string) (*keystonepb.Registration, error)
+	ByGroup(groupID uint64) (*keystonepb.Registration, error)
+	ByKeyLabel(label string) (*keystonepb.Registration, error)
+	ByDevice(device string) (*keystonepb.Registration, error)
+	Close() error
+}
+
+// registrationLocks marks the users whose registration is in
+// progress, so that a user is not registered twice at once: the
+// registry is only written once the user's groups are on chain.
+type registrationLocks struct {
+	mtx  sync.Mutex
+	held map[string]bool
+}
+
+func newRegistrationLocks() *registrationLocks {
+	return &registrationLocks{held: map[string]bool{}}
+}
+
+// tryLock marks the registration of the given user (or device) as in
+// progress, returning false if it already is.
+func (l *registrationLocks) tryLock(key string) bool {
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.held[key] {
+		return false
+	}
+
+	l.held[key] = true
+
+	return true
+}
+
+func (l *registrationLocks) unlock(key string) {
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	delete(l.held, key)
+}
+
+// Key prefixes in the registry database. Registrations are held under
+// the user address, and indexed by group ID, key label and device.
+var (
+	registrationPrefix = []byte{0x01}
+	groupIndexPrefix   = []byte{0x02}
+	labelIndexPrefix   = []byte{0x03}
+	deviceIndexPrefix  = []byte{0x04}
+)
+
+// dbRegistry is a userRegistry held in an embedded key-value
+// database: goleveldb on disk, or in memory for testing.
+type dbRegistry struct {
+	mtx sync.Mutex
+	db  dbm.DB
+}
+
+var _ userRegistry = &dbRegistry{}
+
+// openRegistry opens the user registry of the given type: leveldb, in
+// the given directory, or memory.
+func openRegistry(registryType string, dir string) (userRegistry, error) {
+	switch registryType {
+	case "leveldb":
+		db, err := dbm.NewGoLevelDB("registry", dir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &dbRegistry{db: db}, nil
+	case "memory":
+		return &dbRegistry{db: dbm.NewMemDB()}, nil
+	default:
+		return nil, fmt.Errorf("unknown registry type: %s", registryType)
+	}
+}
+
+// Put adds a registration, which must be for a user address, and from
+// a device, that is not yet registered.
+func (r *dbRegistry) Put(reg *keystonepb.Registration) error {
+
+	if len(reg.UserAddress) == 0 {
+		return errors.New("registration has no user address")
+	}
+
+	bz, err := proto.Marshal(reg)
+
+	if err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	key := prefixed(registrationPrefix, []byte(reg.UserAddress))
+	exists, err := r.db.Has(key)
+
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return errAlreadyRegistered
+	}
+
+	if len(reg.DeviceAddress) > 0 {
+		exists, err = r.db.Has(prefixed(deviceIndexPrefix, []byte(reg.DeviceAddress)))
+
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			return errDeviceRegistered
+		}
+	}
+
+	batch := r.db.NewBatch()
+	defer batch.Close()
+
+	address := []byte(reg.UserAddress)
+	entries := [][2][]byte{
+		{key, bz},
+		{groupKey(reg.AdminGroupId), address},
+		{groupKey(reg.KeyGroupId), address},
+	}
+
+	if len(reg.KeyLabel) > 0 {
+		entries = append(entries, [2][]byte{prefixed(labelIndexPrefix, []byte(reg.KeyLabel)), address})
+	}
+
+	if len(reg.DeviceAddress) > 0 {
+		entries = append(entries, [2][]byte{prefixed(deviceIndexPrefix, []byte(reg.DeviceAddress)), address})
+	}
+
+	for _, e := range entries {
+		if err := batch.Set(e[0], e[1]); err != nil {
+			return err
+		}
+	}
+
+	return batch.WriteSync()
+}
+
+func (r *dbRegistry) ByAddress(address string) (*keystonepb.Registration, error) {
+
+	bz, err := r.db.Get(prefixed(registrationPrefix, []byte(address)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if bz == nil {
+		return nil, errNotRegistered
+	}
+
+	var reg keystonepb.Registration
+
+	err = proto.Unmarshal(bz, &reg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &reg, nil
+}
+
+func (r *dbRegistry) ByGroup(groupID uint64) (*keystonepb.Registration, error) {
+	return r.byIndex(groupKey(groupID))
+}
+
+func (r *dbRegistry) ByKeyLabel(label string) (*keystonepb.Registration, error) {
+	return r.byIndex(prefixed(labelIndexPrefix, []byte(label)))
+}
+
+func (r *dbRegistry) ByDevice(device string) (*keystonepb.Registration, error) {
+	return r.byIndex(prefixed(deviceIndexPrefix, []byte(device)))
+}
+
+func (r *dbRegistry) Close() error {
+	return r.db.Close()
+}
+
+// byIndex returns the registration of the user address held in the
+// given index entry.
+func (r *dbRegistry) byIndex(key []byte) (*keystonepb.Registration, error) {
+
+	address, err := r.db.Get(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if address == nil {
+		return nil, errNotRegistered
+	}
+
+	return r.ByAddress(string(address))
+}
+
+func groupKey(groupID uint64) []byte {
+	bz := make([]byte, 8)
+	binary.BigEndian.PutUint64(bz, groupID)
+	return prefixed(groupIndexPrefix, bz)
+}
+
+func prefixed(prefix []byte, key []byte) []byte {
+	return append(append([]byte{}, prefix...), key...)
+}
+
+// GetRegistration implements the method given in the protobuf
+// definition for the Keystone service (proto/keystone.proto),
+// returning a user's registration. The caller must be the device which
+// registered the user, or a member of the user's admin group. Callers
+// who may not see a registration are told that there is none, so that
+// they cannot find out who is registered.
+func (s *server) GetRegistration(ctx context.Context, in *keystonepb.GetRegistrationRequest) (*keystonepb.RegistrationResponse, error) {
+
+	var reg *keystonepb.Registration
+	var err error
+
+	switch {
+	case len(in.Address) > 0 && in.GroupId == 0 && len(in.KeyLabel) == 0:
+		reg, err = s.Registry.ByAddress(in.Address)
+	case len(in.Address) == 0 && in.GroupId != 0 && len(in.KeyLabel) == 0:
+		reg, err = s.Registry.ByGroup(in.GroupId)
+	case len(in.Address) == 0 && in.GroupId == 0 && len(in.KeyLabel) > 0:
+		reg, err = s.Registry.ByKeyLabel(in.KeyLabel)
+	default:
+		return &keystonepb.RegistrationResponse{Status: STATUS_BAD_REQUEST}, nil
+	}
+
+	if err == errNotRegistered {
+		return &keystonepb.RegistrationResponse{Status: STATUS_KEY_NOT_FOUND}, nil
+	}
+
+	if err != nil {
+		log.Printf("Error looking up registration: %s", err.Error())
+		return nil, err
+	}
+
+	if c, ok := callerFromContext(ctx); s.RequireAuth && (!ok || c.Address.String() != reg.DeviceAddress) {
+		err = s.authorizeMember(ctx, reg.AdminGroupId)
+
+		if err != nil {
+			log.Printf("Unauthorized registration request: %s", err.Error())
+			return &keystonepb.RegistrationResponse{Status: STATUS_KEY_NOT_FOUND}, nil
+		}
+	}
+
+	return &keystonepb.RegistrationResponse{Status: STATUS_OK, Registration: reg}, nil
+}
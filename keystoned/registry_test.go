@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+
+	keystonepb "github.com/regen-network/keystone/keystoned/proto"
+)
+
+func testRegistration() *keystonepb.Registration {
+	return &keystonepb.Registration{
+		UserAddress:       "regen1user",
+		KeyLabel:          "label",
+		DeviceAddress:     "regen1device",
+		AdminGroupId:      1,
+		AdminGroupAddress: "regen1admin",
+		KeyGroupId:        2,
+		KeyGroupAddress:   "regen1key",
+		RegisteredAt:      1634556000,
+	}
+}
+
+func TestRegistryLookups(t *testing.T) {
+	registry := &dbRegistry{db: dbm.NewMemDB()}
+	reg := testRegistration()
+
+	require.NoError(t, registry.Put(reg))
+
+	lookups := map[string]func() (*keystonepb.Registration, error){
+		"address":     func() (*keystonepb.Registration, error) { return registry.ByAddress("regen1user") },
+		"admin group": func() (*keystonepb.Registration, error) { return registry.ByGroup(1) },
+		"key group":   func() (*keystonepb.Registration, error) { return registry.ByGroup(2) },
+		"key label":   func() (*keystonepb.Registration, error) { return registry.ByKeyLabel("label") },
+		"device":      func() (*keystonepb.Registration, error) { return registry.ByDevice("regen1device") },
+	}
+
+	for name, lookup := range lookups {
+		found, err := lookup()
+		require.NoError(t, err, name)
+		require.True(t, proto.Equal(reg, found), name)
+	}
+
+	_, err := registry.ByAddress("regen1other")
+	require.Equal(t, errNotRegistered, err)
+
+	_, err = registry.ByGroup(3)
+	require.Equal(t, errNotRegistered, err)
+
+	_, err = registry.ByKeyLabel("other")
+	require.Equal(t, errNotRegistered, err)
+}
+
+func TestRegistryAlreadyRegistered(t *testing.T) {
+	registry := &dbRegistry{db: dbm.NewMemDB()}
+
+	require.NoError(t, registry.Put(testRegistration()))
+
+	again := testRegistration()
+	again.DeviceAddress = "regen1device2"
+	require.Equal(t, errAlreadyRegistered, registry.Put(again))
+
+	// A device may only register one user
+	other := testRegistration()
+	other.UserAddress = "regen1user2"
+	other.KeyLabel = "label2"
+	require.Equal(t, errDeviceRegistered, registry.Put(other))
+
+	// The failed registrations are not indexed
+	_, err := registry.ByKeyLabel("label2")
+	require.Equal(t, errNotRegistered, err)
+
+	found, err := registry.ByDevice("regen1device")
+	require.NoError(t, err)
+	require.Equal(t, "regen1user", found.UserAddress)
+}
+
+func TestRegistryNoKeyLabel(t *testing.T) {
+	registry := &dbRegistry{db: dbm.NewMemDB()}
+	reg := testRegistration()
+	reg.KeyLabel = ""
+
+	require.NoError(t, registry.Put(reg))
+
+	found, err := registry.ByAddress("regen1user")
+	require.NoError(t, err)
+	require.Empty(t, found.KeyLabel)
+
+	// A registration without a key label is not found by the empty label
+	_, err = registry.ByKeyLabel("")
+	require.Equal(t, errNotRegistered, err)
+}
+
+func TestRegistryNoAddress(t *testing.T) {
+	registry := &dbRegistry{db: dbm.NewMemDB()}
+	reg := testRegistration()
+	reg.UserAddress = ""
+
+	require.Error(t, registry.Put(reg))
+}
+
+func TestGetRegistration(t *testing.T) {
+	device := secp256k1.GenPrivKey()
+	reg := testRegistration()
+	reg.DeviceAddress = sdk.AccAddress(device.PubKey().Address()).String()
+
+	s := &server{RequireAuth: true, Registry: &dbRegistry{db: dbm.NewMemDB()}}
+	require.NoError(t, s.Registry.Put(reg))
+
+	res, err := s.GetRegistration(callerContext(device), &keystonepb.GetRegistrationRequest{KeyLabel: "label"})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_OK, res.Status)
+	require.True(t, proto.Equal(reg, res.Registration))
+
+	res, err = s.GetRegistration(callerContext(device), &keystonepb.GetRegistrationRequest{GroupId: 2})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_OK, res.Status)
+
+	// A registration which the caller may not see looks the same as
+	// one which does not exist
+	res, err = s.GetRegistration(context.Background(), &keystonepb.GetRegistrationRequest{KeyLabel: "label"})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_KEY_NOT_FOUND, res.Status)
+	require.Nil(t, res.Registration)
+
+	res, err = s.GetRegistration(callerContext(device), &keystonepb.GetRegistrationRequest{KeyLabel: "other"})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_KEY_NOT_FOUND, res.Status)
+
+	// Exactly one lookup must be given
+	res, err = s.GetRegistration(callerContext(device), &keystonepb.GetRegistrationRequest{Address: reg.UserAddress, KeyLabel: "label"})
+	require.NoError(t, err)
+	require.Equal(t, STATUS_BAD_REQUEST, res.Status)
+}
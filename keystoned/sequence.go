@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/cosmos/cosmos-sdk/client"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// sequenceManager hands out account sequences to the transactions
+// signed by each Keystone key, so that concurrent requests do not
+// sign transactions with the same sequence. Transactions from one
+// signer are built and broadcast one at a time, but do not have to
+// wait for earlier ones to be included in a block: the next sequence
+// is tracked locally, and only read from the chain the first time it
+// is needed, or after the chain has rejected a sequence.
+type sequenceManager struct {
+	mtx      sync.Mutex
+	accounts map[string]*accountSequence
+}
+
+// accountSequence is the sequence state of a single signer. It is
+// locked from when a transaction is built until it has been
+// broadcast.
+type accountSequence struct {
+	mtx    sync.Mutex
+	loaded bool
+	accNum uint64
+	seq    uint64
+}
+
+func newSequenceManager() *sequenceManager {
+	return &sequenceManager{accounts: map[string]*accountSequence{}}
+}
+
+// lock locks, and returns, the sequence state of the given signer.
+// The caller must call unlock once its transaction has been
+// broadcast.
+func (m *sequenceManager) lock(addr sdk.AccAddress) *accountSequence {
+
+	m.mtx.Lock()
+	account, ok := m.accounts[addr.String()]
+
+	if !ok {
+		account = &accountSequence{}
+		m.accounts[addr.String()] = account
+	}
+
+	m.mtx.Unlock()
+
+	account.mtx.Lock()
+
+	return account
+}
+
+func (a *accountSequence) unlock() {
+	a.mtx.Unlock()
+}
+
+// next returns the account number and sequence for the signer's next
+// transaction, reading them from the chain if they are not known.
+func (a *accountSequence) next(localContext *client.Context, addr sdk.AccAddress) (uint64, uint64, error) {
+
+	if a.loaded {
+		return a.accNum, a.seq, nil
+	}
+
+	err := localContext.AccountRetriever.EnsureExists(*localContext, addr)
+
+	if err != nil {
+		log.Printf("Account %s does not exist: %s", addr.String(), err.Error())
+		return 0, 0, err
+	}
+
+	accNum, seq, err := localContext.AccountRetriever.GetAccountNumberSequence(*localContext, addr)
+
+	if err != nil {
+		log.Printf("Error retrieving account number/sequence: %s", err.Error())
+		return 0, 0, err
+	}
+
+	log.Printf("Account %s retrieved: %d with seq: %d", addr.String(), accNum, seq)
+
+	a.accNum, a.seq, a.loaded = accNum, seq, true
+
+	return accNum, seq, nil
+}
+
+// advance records that the current sequence has been used by a
+// transaction accepted for broadcast.
+func (a *accountSequence) advance() {
+	a.seq++
+}
+
+// reset forgets the sequence, so that it is read from the chain again
+// for the next transaction.
+func (a *accountSequence) reset() {
+	a.loaded = false
+}
+
+// isSequenceMismatch returns true if a transaction was rejected, with
+// the given error code and codespace, because of its sequence.
+func isSequenceMismatch(code uint32, codespace string) bool {
+	return codespace == sdkerrors.RootCodespace && code == sdkerrors.ErrWrongSequence.ABCICode()
+}
+
+// isSequenceMismatchErr returns true if the error (for example, from
+// simulating a transaction) was caused by the transaction sequence.
+func isSequenceMismatchErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), sdkerrors.ErrWrongSequence.Error())
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsSequenceMismatch(t *testing.T) {
+	require.True(t, isSequenceMismatch(sdkerrors.ErrWrongSequence.ABCICode(), sdkerrors.RootCodespace))
+
+	// The same code in another module's codespace is a different error
+	require.False(t, isSequenceMismatch(sdkerrors.ErrWrongSequence.ABCICode(), "group"))
+	require.False(t, isSequenceMismatch(sdkerrors.ErrInsufficientFunds.ABCICode(), sdkerrors.RootCodespace))
+	require.False(t, isSequenceMismatch(0, ""))
+}
+
+func TestIsSequenceMismatchErr(t *testing.T) {
+	err := sdkerrors.Wrapf(sdkerrors.ErrWrongSequence, "account sequence mismatch, expected %d, got %d", 2, 1)
+	require.True(t, isSequenceMismatchErr(err))
+	require.True(t, isSequenceMismatchErr(errors.New("rpc error: code = Unknown desc = "+err.Error())))
+
+	require.False(t, isSequenceMismatchErr(nil))
+	require.False(t, isSequenceMismatchErr(sdkerrors.ErrInsufficientFunds))
+}
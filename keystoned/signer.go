@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+
+	"github.com/cosmos/cosmos-sdk/client"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/types/tx/signing"
+	authsigning "github.com/cosmos/cosmos-sdk/x/auth/signing"
+
+	"github.com/regen-network/keystone/keys"
+)
+
+// keyAddress returns the Cosmos account address of a key held in a
+// keys.Keyring.
+func keyAddress(key *keys.CryptoKey) sdk.AccAddress {
+	return sdk.AccAddress(key.PubKey().Address())
+}
+
+// signTx signs the transaction in the given builder with a key held
+// in a keys.Keyring, using SIGN_MODE_DIRECT, and sets the signature
+// and public key on the builder. It does the same job as the Cosmos
+// SDK tx.Sign, but without the key bytes ever leaving the keyring.
+// Only transactions with a single signer are supported.
+func signTx(txConfig client.TxConfig, txBuilder client.TxBuilder, key *keys.CryptoKey, chainID string, accNum uint64, seq uint64) error {
+
+	signMode := signing.SignMode_SIGN_MODE_DIRECT
+
+	// The signer info (public key, sign mode and sequence) is part of
+	// the bytes that are signed in SIGN_MODE_DIRECT, so it must be
+	// set, with an empty signature, before the sign bytes are built.
+	err := setSignerInfo(txBuilder, key, seq)
+
+	if err != nil {
+		return err
+	}
+
+	signerData := authsigning.SignerData{
+		ChainID:       chainID,
+		AccountNumber: accNum,
+		Sequence:      seq,
+	}
+
+	signBytes, err := txConfig.SignModeHandler().GetSignBytes(signMode, signerData, txBuilder.GetTx())
+
+	if err != nil {
+		log.Printf("Error getting sign bytes: %s", err.Error())
+		return err
+	}
+
+	// The default signing profile of the key is the one the chain
+	// expects: SHA-256 and low-s raw ECDSA, or EdDSA
+	signature, err := key.Sign(signBytes, nil)
+
+	if err != nil {
+		log.Printf("Error signing transaction: %s", err.Error())
+		return err
+	}
+
+	sigV2 := signing.SignatureV2{
+		PubKey: key.PubKey(),
+		Data: &signing.SingleSignatureData{
+			SignMode:  signMode,
+			Signature: signature,
+		},
+		Sequence: seq,
+	}
+
+	return txBuilder.SetSignatures(sigV2)
+}
+
+// setSignerInfo sets the signer info for the given key on the
+// transaction in the builder, with an empty signature. This is needed
+// both before signing, and to simulate the transaction, as the gas
+// used depends on the signer's public key.
+func setSignerInfo(txBuilder client.TxBuilder, key *keys.CryptoKey, seq uint64) error {
+
+	sigV2 := signing.SignatureV2{
+		PubKey: key.PubKey(),
+		Data: &signing.SingleSignatureData{
+			SignMode:  signing.SignMode_SIGN_MODE_DIRECT,
+			Signature: nil,
+		},
+		Sequence: seq,
+	}
+
+	return txBuilder.SetSignatures(sigV2)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/types/tx/signing"
+	authsigning "github.com/cosmos/cosmos-sdk/x/auth/signing"
+	banktypes "github.com/cosmos/cosmos-sdk/x/bank/types"
+
+	"github.com/regen-network/keystone/keys"
+)
+
+func TestSignTx(t *testing.T) {
+	for _, algo := range []keys.KeygenAlgorithm{keys.KEYGEN_SECP256K1, keys.KEYGEN_SECP256R1, keys.KEYGEN_ED25519} {
+		key, err := keys.NewInMemoryKeyring().NewKey(algo, "signer")
+		require.NoError(t, err)
+
+		txConfig := makeEncodingConfig().TxConfig
+		txBuilder := txConfig.NewTxBuilder()
+		from := keyAddress(key)
+		require.NoError(t, txBuilder.SetMsgs(banktypes.NewMsgSend(from, from, sdk.NewCoins(sdk.NewInt64Coin("uregen", 1)))))
+		txBuilder.SetGasLimit(100000)
+
+		require.NoError(t, signTx(txConfig, txBuilder, key, "test-chain", 7, 3))
+
+		sigs, err := txBuilder.GetTx().GetSignaturesV2()
+		require.NoError(t, err)
+		require.Len(t, sigs, 1)
+		require.True(t, key.PubKey().Equals(sigs[0].PubKey))
+		require.Equal(t, uint64(3), sigs[0].Sequence)
+
+		data, ok := sigs[0].Data.(*signing.SingleSignatureData)
+		require.True(t, ok)
+		require.Equal(t, signing.SignMode_SIGN_MODE_DIRECT, data.SignMode)
+
+		// The signature verifies over the sign bytes the chain builds
+		// from the signer data, and over no others
+		signerData := authsigning.SignerData{ChainID: "test-chain", AccountNumber: 7, Sequence: 3}
+		signBytes, err := txConfig.SignModeHandler().GetSignBytes(signing.SignMode_SIGN_MODE_DIRECT, signerData, txBuilder.GetTx())
+		require.NoError(t, err)
+		require.True(t, sigs[0].PubKey.VerifySignature(signBytes, data.Signature))
+
+		signerData.AccountNumber = 8
+		otherBytes, err := txConfig.SignModeHandler().GetSignBytes(signing.SignMode_SIGN_MODE_DIRECT, signerData, txBuilder.GetTx())
+		require.NoError(t, err)
+		require.False(t, sigs[0].PubKey.VerifySignature(otherBytes, data.Signature))
+
+		// The signed transaction survives encoding
+		txBytes, err := txConfig.TxEncoder()(txBuilder.GetTx())
+		require.NoError(t, err)
+		decoded, err := txConfig.TxDecoder()(txBytes)
+		require.NoError(t, err)
+		decodedBytes, err := txConfig.SignModeHandler().GetSignBytes(signing.SignMode_SIGN_MODE_DIRECT, authsigning.SignerData{ChainID: "test-chain", AccountNumber: 7, Sequence: 3}, decoded)
+		require.NoError(t, err)
+		require.Equal(t, signBytes, decodedBytes)
+	}
+}
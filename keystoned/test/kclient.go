@@ -3,20 +3,134 @@ package main
 import (
 	"log"
 	"context"
+	"crypto/rand"
 	"fmt"
+	"time"
 	
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	codectypes "github.com/cosmos/cosmos-sdk/codec/types"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	sdk "github.com/cosmos/cosmos-sdk/types"
 	
 	keystonepb "github.com/regen-network/keystone/keystoned/proto"
 )
 
+// signRequests returns a client interceptor which sends each request
+// with an envelope signed by the given device key, as the Keystone
+// server requires.
+func signRequests(device *secp256k1.PrivKey) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		pubKey, err := codectypes.NewAnyWithValue(device.PubKey())
+
+		if err != nil {
+			return err
+		}
+
+		request, err := proto.MarshalOptions{Deterministic: true}.Marshal(req.(proto.Message))
+
+		if err != nil {
+			return err
+		}
+
+		timestamp := time.Now().Unix()
+		nonce := make([]byte, 16)
+
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+
+		signDoc, err := proto.MarshalOptions{Deterministic: true}.Marshal(&keystonepb.RequestAuthSignDoc{
+			Method:    method,
+			Timestamp: timestamp,
+			Request:   request,
+			Nonce:     nonce,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		signature, err := device.Sign(signDoc)
+
+		if err != nil {
+			return err
+		}
+
+		auth, err := proto.Marshal(&keystonepb.RequestAuth{
+			PublicKey: &anypb.Any{TypeUrl: pubKey.TypeUrl, Value: pubKey.Value},
+			Timestamp: timestamp,
+			Signature: signature,
+			Nonce:     nonce,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-keystone-auth-bin", string(auth))
+
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// deviceSignRequest returns a sign request for the given bytes and
+// key, with the proof that it was made by the given device.
+func deviceSignRequest(device *secp256k1.PrivKey, forSigning []byte, keyLabel string) (*keystonepb.SignRequest, error) {
+	pubKey, err := codectypes.NewAnyWithValue(device.PubKey())
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	timestamp := time.Now().Unix()
+
+	signDoc, err := proto.MarshalOptions{Deterministic: true}.Marshal(&keystonepb.SignRequestSignDoc{
+		ForSigning: forSigning,
+		KeyLabel:   keyLabel,
+		Nonce:      nonce,
+		Timestamp:  timestamp,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := device.Sign(signDoc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &keystonepb.SignRequest{
+		ForSigning:      forSigning,
+		KeyLabel:        keyLabel,
+		DevicePublicKey: &anypb.Any{TypeUrl: pubKey.TypeUrl, Value: pubKey.Value},
+		Nonce:           nonce,
+		Timestamp:       timestamp,
+		DeviceSignature: signature,
+	}, nil
+}
+
 func main() {
 	
 	fmt.Println("Keystone client ...")
 
-	opts := grpc.WithInsecure()
-	
-	cc, err := grpc.Dial("localhost:8080", opts)
+	sdk.GetConfig().SetBech32PrefixForAccount("regen", "regenpub")
+
+	// A new device key for the user, which signs every request
+	device := secp256k1.GenPrivKey()
+
+	cc, err := grpc.Dial("localhost:8080", grpc.WithInsecure(), grpc.WithUnaryInterceptor(signRequests(device)))
 	
 	if err != nil {
 		log.Fatal(err)
@@ -26,17 +140,42 @@ func main() {
 
 	client := keystonepb.NewKeystoneServiceClient(cc)
 
-	request := &keystonepb.RegisterRequest{Address: "regen1fyccfg8ylh79ey2qdtx677k568mn0q3pnkajfk"}
+	// No address is given, so Keystone creates a key for the user
+	request := &keystonepb.RegisterRequest{}
+
+	resp, err := client.Register(context.Background(), request)
 
-	resp, _ := client.Register(context.Background(), request)
+	if err != nil {
+		log.Fatalf("Register failed: %v", err)
+	}
 	
-	fmt.Printf("Receive response => [%v]", resp.Greeting)
+	fmt.Printf("Receive response => user: %s admin group: %s key group: %s\n", resp.UserAddress, resp.AdminGroupAddress, resp.KeyGroupAddress)
+
+	regResp, err := client.GetRegistration(context.Background(), &keystonepb.GetRegistrationRequest{Address: resp.UserAddress})
+
+	if err != nil {
+		log.Fatalf("GetRegistration failed: %v", err)
+	}
+
+	if regResp.Registration == nil {
+		log.Fatalf("No registration found => [%v]", regResp.Status)
+	}
+
+	fmt.Printf("Registration => key: %s device: %s\n", regResp.Registration.KeyLabel, regResp.Registration.DeviceAddress)
 
 	cleartext := "For signing"
 	
-	signRequest := &keystonepb.SignRequest{ForSigning: []byte(cleartext)}
+	signRequest, err := deviceSignRequest(device, []byte(cleartext), regResp.Registration.KeyLabel)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signResp, err := client.Sign(context.Background(), signRequest)
 
-	signResp, _ := client.Sign(context.Background(), signRequest)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	fmt.Printf("Signing response => [%v]", signResp.Status)
+	fmt.Printf("Signing response => [%v] signature: %x pubkey: %x", signResp.Status, signResp.SignedBytes, signResp.PublicKey)
 }
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	abci "github.com/tendermint/tendermint/abci/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cosmos/cosmos-sdk/client"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/types/tx"
+
+	"github.com/regen-network/keystone/keys"
+)
+
+// Default time to wait for a broadcast transaction to be included in
+// a block, and the interval at which the chain is polled for it.
+const (
+	TX_WAIT_TIMEOUT  = 60 * time.Second
+	TX_POLL_INTERVAL = time.Second
+)
+
+// SEQUENCE_RETRIES is the number of times a transaction is sent again
+// after the chain rejects its sequence.
+const SEQUENCE_RETRIES = 2
+
+// chainClient sends transactions to a chain node, over the node's
+// RPC endpoint (for account queries) and gRPC endpoint (for
+// broadcasting and tracking transactions). The response of every
+// transaction it broadcasts is recorded in Results, in order, so that
+// they can be reported to the caller whether or not they succeeded.
+type chainClient struct {
+	Context       *client.Context
+	Conn          *grpc.ClientConn
+	BroadcastMode tx.BroadcastMode
+	Timeout       time.Duration
+	Fee           feePolicy
+	Sequences     *sequenceManager
+	Results       []*sdk.TxResponse
+}
+
+// feePolicy decides the gas limit and fee of a transaction. If
+// GasLimit is set it is used as is, otherwise the gas is estimated by
+// simulating the transaction, and multiplied by GasAdjustment. If Fees
+// is set it is paid as is, otherwise the fee is the gas limit
+// multiplied by GasPrices.
+type feePolicy struct {
+	GasLimit      uint64
+	GasAdjustment float64
+	Fees          sdk.Coins
+	GasPrices     sdk.DecCoins
+}
+
+// txRequest is a transaction to be built, signed and sent by a
+// chainClient. Signer is the Keystone key which signs the transaction
+// (and so must be the signer of all the messages) and pays its fee. If
+// Fee is nil, the fee policy of the client is used. A TimeoutHeight of
+// 0 means the transaction does not time out.
+type txRequest struct {
+	Msgs          []sdk.Msg
+	Signer        *keys.CryptoKey
+	Memo          string
+	Fee           *feePolicy
+	TimeoutHeight uint64
+}
+
+// parseBroadcastMode returns the broadcast mode with the given name:
+// sync, async or block.
+func parseBroadcastMode(mode string) (tx.BroadcastMode, error) {
+	switch mode {
+	case "sync":
+		return tx.BroadcastMode_BROADCAST_MODE_SYNC, nil
+	case "async":
+		return tx.BroadcastMode_BROADCAST_MODE_ASYNC, nil
+	case "block":
+		return tx.BroadcastMode_BROADCAST_MODE_BLOCK, nil
+	default:
+		return tx.BroadcastMode_BROADCAST_MODE_UNSPECIFIED, fmt.Errorf("unknown broadcast mode: %s", mode)
+	}
+}
+
+// sendTx builds and signs the requested transaction, broadcasts it,
+// and waits for it to be included in a block. The response of the
+// included transaction is returned, from which the results of the
+// messages can be read with msgResult and msgEvents. An error is
+// returned if the transaction fails, either when broadcast or when
+// executed, or if it is not included before the client timeout.
+func (c *chainClient) sendTx(req *txRequest) (*sdk.TxResponse, error) {
+
+	txClient := tx.NewServiceClient(c.Conn)
+	res, err := c.broadcastTx(txClient, req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Transaction %s broadcast", res.TxHash)
+
+	included, err := c.confirmTx(txClient, res)
+
+	if err != nil {
+		log.Printf("Error confirming transaction %s: %s", res.TxHash, err.Error())
+		return nil, err
+	}
+
+	if len(included.Logs) != len(req.Msgs) {
+		return nil, fmt.Errorf("transaction %s has %d message logs, expected %d", included.TxHash, len(included.Logs), len(req.Msgs))
+	}
+
+	return included, nil
+}
+
+// broadcastTx builds, signs and broadcasts the requested transaction
+// with the next sequence of its signer, and returns the broadcast
+// response. Transactions from the same signer are broadcast one at a
+// time. If the chain rejects the sequence, which happens when the
+// signer has also sent transactions from elsewhere, the sequence is
+// read from the chain again and the transaction is sent again, up to
+// SEQUENCE_RETRIES times.
+func (c *chainClient) broadcastTx(txClient tx.ServiceClient, req *txRequest) (*sdk.TxResponse, error) {
+
+	signerAddr := keyAddress(req.Signer)
+	account := c.Sequences.lock(signerAddr)
+	defer account.unlock()
+
+	for attempt := 0; ; attempt++ {
+		num, seq, err := account.next(c.Context, signerAddr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		txBytes, err := c.buildTx(req, num, seq)
+
+		if isSequenceMismatchErr(err) && attempt < SEQUENCE_RETRIES {
+			log.Printf("Sequence %d rejected for %s, resyncing", seq, signerAddr.String())
+			account.reset()
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := txClient.BroadcastTx(
+			context.Background(),
+			&tx.BroadcastTxRequest{
+				Mode:    c.BroadcastMode,
+				TxBytes: txBytes,
+			},
+		)
+
+		if err != nil {
+			log.Printf("Error broadcasting: %s", err.Error())
+			account.reset()
+			return nil, err
+		}
+
+		if isSequenceMismatch(res.TxResponse.Code, res.TxResponse.Codespace) && attempt < SEQUENCE_RETRIES {
+			log.Printf("Sequence %d rejected for %s, resyncing", seq, signerAddr.String())
+			account.reset()
+			continue
+		}
+
+		// The sequence is used by any transaction that got past the
+		// ante handler: that is, unless it was rejected when checked
+		if res.TxResponse.Code == 0 || res.TxResponse.Height > 0 {
+			account.advance()
+		} else {
+			account.reset()
+		}
+
+		return res.TxResponse, nil
+	}
+}
+
+// buildTx builds the requested transaction, with the given account
+// number and sequence of its signer, sets its gas and fee, and signs
+// it. The encoded transaction is returned, ready for broadcasting.
+func (c *chainClient) buildTx(req *txRequest, num uint64, seq uint64) ([]byte, error) {
+
+	localContext := c.Context
+	encCfg := makeEncodingConfig()
+	txBuilder := encCfg.TxConfig.NewTxBuilder()
+
+	err := txBuilder.SetMsgs(req.Msgs...)
+
+	if err != nil {
+		log.Printf("Error setting messages: %s", err.Error())
+		return nil, err
+	}
+
+	txBuilder.SetMemo(req.Memo)
+	txBuilder.SetTimeoutHeight(req.TimeoutHeight)
+
+	fee := &c.Fee
+
+	if req.Fee != nil {
+		fee = req.Fee
+	}
+
+	err = c.setFee(txBuilder, fee, req.Signer, seq)
+
+	if err != nil {
+		log.Printf("Error estimating fee: %s", err.Error())
+		return nil, err
+	}
+
+	err = signTx(encCfg.TxConfig, txBuilder, req.Signer, localContext.ChainID, num, seq)
+
+	if err != nil {
+		log.Printf("Error signing: %s", err.Error())
+		return nil, err
+	}
+
+	txBytes, err := localContext.TxConfig.TxEncoder()(txBuilder.GetTx())
+
+	if err != nil {
+		log.Printf("Error encoding transaction: %s", err.Error())
+		return nil, err
+	}
+
+	return txBytes, nil
+}
+
+// setFee sets the gas limit and fee of the transaction in the builder
+// following the given fee policy. If the gas must be estimated, the
+// transaction is simulated, signed by the given key.
+func (c *chainClient) setFee(txBuilder client.TxBuilder, policy *feePolicy, signer *keys.CryptoKey, seq uint64) error {
+
+	gas := policy.GasLimit
+
+	if gas == 0 {
+		used, err := c.simulateTx(txBuilder, signer, seq)
+
+		if err != nil {
+			return err
+		}
+
+		gas = policy.adjustGas(used)
+		log.Printf("Estimated gas: %d, limit: %d", used, gas)
+	}
+
+	fees := policy.fees(gas)
+
+	log.Printf("Gas limit: %d, fee: %s", gas, fees)
+
+	txBuilder.SetGasLimit(gas)
+	txBuilder.SetFeeAmount(fees)
+
+	return nil
+}
+
+// adjustGas returns the gas limit for a transaction which used the
+// given gas when simulated.
+func (p *feePolicy) adjustGas(used uint64) uint64 {
+	return uint64(p.GasAdjustment * float64(used))
+}
+
+// fees returns the fee for a transaction with the given gas limit:
+// the fixed fees of the policy if it has them, otherwise the gas
+// limit multiplied by each gas price, rounded up. Denoms whose fee
+// is zero are left out, as zero coins are not valid in a fee.
+func (p *feePolicy) fees(gas uint64) sdk.Coins {
+
+	if p.Fees != nil {
+		return p.Fees
+	}
+
+	gasLimit := sdk.NewDec(int64(gas))
+	fees := sdk.Coins{}
+
+	for _, price := range p.GasPrices {
+		fee := sdk.NewCoin(price.Denom, price.Amount.Mul(gasLimit).Ceil().RoundInt())
+
+		if fee.IsZero() {
+			continue
+		}
+
+		fees = append(fees, fee)
+	}
+
+	return fees.Sort()
+}
+
+// simulateTx simulates the transaction in the builder, signed by the
+// given key, and returns the gas it used.
+func (c *chainClient) simulateTx(txBuilder client.TxBuilder, signer *keys.CryptoKey, seq uint64) (uint64, error) {
+
+	err := setSignerInfo(txBuilder, signer, seq)
+
+	if err != nil {
+		return 0, err
+	}
+
+	txBytes, err := c.Context.TxConfig.TxEncoder()(txBuilder.GetTx())
+
+	if err != nil {
+		return 0, err
+	}
+
+	sim, err := tx.NewServiceClient(c.Conn).Simulate(context.Background(), &tx.SimulateRequest{TxBytes: txBytes})
+
+	if err != nil {
+		log.Printf("Error simulating transaction: %s", err.Error())
+		return 0, err
+	}
+
+	return sim.GasInfo.GasUsed, nil
+}
+
+// confirmTx tracks a broadcast transaction until it has been
+// included in a block, given the response to its broadcast, and
+// records its final response in the client results. A transaction
+// which fails, either when checked or when executed, is reported as an
+// error, as is one which is not included before the client timeout (in
+// which case the recorded response has no height).
+func (c *chainClient) confirmTx(txClient tx.ServiceClient, broadcast *sdk.TxResponse) (*sdk.TxResponse, error) {
+
+	// In sync and block modes, a failure here means the transaction
+	// was never added to the mempool, or (in block mode) that it
+	// failed when executed
+	if broadcast.Code != 0 {
+		c.Results = append(c.Results, broadcast)
+		return nil, fmt.Errorf("transaction %s rejected with code %d: %s", broadcast.TxHash, broadcast.Code, broadcast.RawLog)
+	}
+
+	included := broadcast
+
+	// Only in block mode does the broadcast response come from the
+	// block the transaction was included in
+	if broadcast.Height == 0 {
+		var err error
+		included, err = waitForTx(txClient, broadcast.TxHash, c.Timeout)
+
+		if err != nil {
+			c.Results = append(c.Results, &sdk.TxResponse{TxHash: broadcast.TxHash, RawLog: err.Error()})
+			return nil, err
+		}
+	}
+
+	c.Results = append(c.Results, included)
+
+	if included.Code != 0 {
+		return nil, fmt.Errorf("transaction %s failed with code %d: %s", included.TxHash, included.Code, included.RawLog)
+	}
+
+	return included, nil
+}
+
+// waitForTx polls the chain for the transaction with the given hash
+// until it has been included in a block, and returns its response. An
+// error is returned if it is not included within the timeout.
+func waitForTx(txClient tx.ServiceClient, hash string, timeout time.Duration) (*sdk.TxResponse, error) {
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		res, err := txClient.GetTx(context.Background(), &tx.GetTxRequest{Hash: hash})
+
+		if err == nil {
+			log.Printf("Transaction %s included at height %d", hash, res.TxResponse.Height)
+			return res.TxResponse, nil
+		}
+
+		// Any error other than the transaction not (yet) being
+		// found means that the query itself failed
+		if !isTxNotFound(err, hash) {
+			return nil, err
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("transaction %s not included after %s", hash, timeout)
+		}
+
+		time.Sleep(TX_POLL_INTERVAL)
+	}
+}
+
+// isTxNotFound returns true if the error from querying the
+// transaction with the given hash means that it has not been included
+// in a block (yet). The Cosmos SDK tx service passes on the error from
+// Tendermint as is, with no gRPC status code, so its message is
+// matched as well as the NotFound code.
+func isTxNotFound(err error, hash string) bool {
+
+	if status.Code(err) == codes.NotFound {
+		return true
+	}
+
+	notFound := fmt.Sprintf("tx (%s) not found", strings.ToLower(hash))
+
+	return strings.Contains(strings.ToLower(err.Error()), notFound)
+}
+
+// msgResult decodes the result of the message at the given index in
+// a transaction into the given message response type. The result is
+// taken from the transaction data, which holds one result per
+// message, in order.
+func msgResult(res *sdk.TxResponse, index int, out interface{ Unmarshal([]byte) error }) error {
+
+	data, err := hex.DecodeString(res.Data)
+
+	if err != nil {
+		log.Printf("Error decoding transaction data: %s", err.Error())
+		return err
+	}
+
+	var msgData sdk.TxMsgData
+
+	err = msgData.Unmarshal(data)
+
+	if err != nil {
+		log.Printf("Error decoding transaction data: %s", err.Error())
+		return err
+	}
+
+	if index >= len(msgData.Data) {
+		return fmt.Errorf("transaction %s has no result for message %d", res.TxHash, index)
+	}
+
+	return out.Unmarshal(msgData.Data[index].Data)
+}
+
+// msgEvents returns the typed events (those emitted as protobuf
+// messages, such as the group module events) emitted by the message
+// at the given index in a transaction. Events which are not typed
+// events are skipped.
+func msgEvents(res *sdk.TxResponse, index int) []proto.Message {
+
+	var events []proto.Message
+
+	for _, msgLog := range res.Logs {
+		if int(msgLog.MsgIndex) != index {
+			continue
+		}
+
+		for _, event := range msgLog.Events {
+			attrs := make([]abci.EventAttribute, 0, len(event.Attributes))
+
+			for _, attr := range event.Attributes {
+				attrs = append(attrs, abci.EventAttribute{Key: []byte(attr.Key), Value: []byte(attr.Value)})
+			}
+
+			typed, err := sdk.ParseTypedEvent(abci.Event{Type: event.Type, Attributes: attrs})
+
+			if err != nil {
+				continue
+			}
+
+			events = append(events, typed)
+		}
+	}
+
+	return events
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/types/tx"
+	govtypes "github.com/cosmos/cosmos-sdk/x/gov/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseBroadcastMode(t *testing.T) {
+	modes := map[string]tx.BroadcastMode{
+		"sync":  tx.BroadcastMode_BROADCAST_MODE_SYNC,
+		"async": tx.BroadcastMode_BROADCAST_MODE_ASYNC,
+		"block": tx.BroadcastMode_BROADCAST_MODE_BLOCK,
+	}
+
+	for name, expected := range modes {
+		mode, err := parseBroadcastMode(name)
+		require.NoError(t, err)
+		require.Equal(t, expected, mode)
+	}
+
+	for _, name := range []string{"", "Sync", "unspecified"} {
+		mode, err := parseBroadcastMode(name)
+		require.Error(t, err)
+		require.Equal(t, tx.BroadcastMode_BROADCAST_MODE_UNSPECIFIED, mode)
+	}
+}
+
+func TestMsgResult(t *testing.T) {
+	first, err := (&govtypes.MsgSubmitProposalResponse{ProposalId: 1}).Marshal()
+	require.NoError(t, err)
+	second, err := (&govtypes.MsgSubmitProposalResponse{ProposalId: 2}).Marshal()
+	require.NoError(t, err)
+
+	msgData := sdk.TxMsgData{Data: []*sdk.MsgData{
+		{MsgType: "/cosmos.gov.v1beta1.MsgSubmitProposal", Data: first},
+		{MsgType: "/cosmos.gov.v1beta1.MsgSubmitProposal", Data: second},
+	}}
+	data, err := msgData.Marshal()
+	require.NoError(t, err)
+
+	res := &sdk.TxResponse{TxHash: "ABCD", Data: hex.EncodeToString(data)}
+
+	var out govtypes.MsgSubmitProposalResponse
+	require.NoError(t, msgResult(res, 1, &out))
+	require.Equal(t, uint64(2), out.ProposalId)
+
+	require.NoError(t, msgResult(res, 0, &out))
+	require.Equal(t, uint64(1), out.ProposalId)
+
+	require.Error(t, msgResult(res, 2, &out))
+	require.Error(t, msgResult(&sdk.TxResponse{Data: "not hex"}, 0, &out))
+	require.Error(t, msgResult(&sdk.TxResponse{Data: "ff"}, 0, &out))
+}
+
+// fakeTxService is a tx.ServiceClient whose GetTx returns the given
+// errors in turn, and then the transaction.
+type fakeTxService struct {
+	tx.ServiceClient
+	errs  []error
+	calls int
+}
+
+func (f *fakeTxService) GetTx(ctx context.Context, in *tx.GetTxRequest, opts ...grpc.CallOption) (*tx.GetTxResponse, error) {
+	f.calls++
+
+	if f.calls <= len(f.errs) {
+		return nil, f.errs[f.calls-1]
+	}
+
+	return &tx.GetTxResponse{TxResponse: &sdk.TxResponse{TxHash: in.Hash, Height: 10}}, nil
+}
+
+// tendermintNotFound is the error returned by the Cosmos SDK v0.43 tx
+// service for a transaction that is not in a block.
+func tendermintNotFound(hash string) error {
+	return status.Error(codes.Unknown, fmt.Sprintf("RPC error -32603 - Internal error: tx (%s) not found", hash))
+}
+
+func TestWaitForTx(t *testing.T) {
+	hash := "0AB1C2"
+
+	// Not found, then included
+	txClient := &fakeTxService{errs: []error{tendermintNotFound(hash)}}
+	res, err := waitForTx(txClient, hash, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), res.Height)
+	require.Equal(t, 2, txClient.calls)
+
+	txClient = &fakeTxService{errs: []error{status.Error(codes.NotFound, "not found")}}
+	_, err = waitForTx(txClient, hash, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 2, txClient.calls)
+
+	// Not included before the timeout
+	txClient = &fakeTxService{errs: []error{tendermintNotFound(hash), tendermintNotFound(hash)}}
+	_, err = waitForTx(txClient, hash, 0)
+	require.Error(t, err)
+	require.Equal(t, 1, txClient.calls)
+
+	// Other errors fail the query straight away
+	txClient = &fakeTxService{errs: []error{status.Error(codes.Unavailable, "connection refused")}}
+	_, err = waitForTx(txClient, hash, time.Minute)
+	require.Error(t, err)
+	require.Equal(t, 1, txClient.calls)
+
+	// As does a different transaction not being found
+	txClient = &fakeTxService{errs: []error{tendermintNotFound("FFFF")}}
+	_, err = waitForTx(txClient, hash, time.Minute)
+	require.Error(t, err)
+	require.Equal(t, 1, txClient.calls)
+}
+
+func TestIsTxNotFound(t *testing.T) {
+	require.True(t, isTxNotFound(tendermintNotFound("0AB1C2"), "0ab1c2"))
+	require.True(t, isTxNotFound(errors.New("tx (0AB1C2) not found"), "0AB1C2"))
+	require.True(t, isTxNotFound(status.Error(codes.NotFound, "tx not found"), "0AB1C2"))
+	require.False(t, isTxNotFound(errors.New("account not found"), "0AB1C2"))
+}
+
+func TestFeePolicy(t *testing.T) {
+	prices := sdk.NewDecCoins(sdk.NewDecCoinFromDec("uregen", sdk.MustNewDecFromStr("0.1")), sdk.NewDecCoinFromDec("uatom", sdk.MustNewDecFromStr("0.025")))
+
+	tests := []struct {
+		name   string
+		policy feePolicy
+		used   uint64
+		gas    uint64
+		fees   sdk.Coins
+	}{
+		{
+			name:   "adjusted gas",
+			policy: feePolicy{GasAdjustment: 1.5, GasPrices: prices},
+			used:   100000,
+			gas:    150000,
+			fees:   sdk.NewCoins(sdk.NewInt64Coin("uatom", 3750), sdk.NewInt64Coin("uregen", 15000)),
+		},
+		{
+			name:   "fee rounded up per denom",
+			policy: feePolicy{GasAdjustment: 1, GasPrices: prices},
+			used:   1001,
+			gas:    1001,
+			fees:   sdk.NewCoins(sdk.NewInt64Coin("uatom", 26), sdk.NewInt64Coin("uregen", 101)),
+		},
+		{
+			name:   "zero gas price left out",
+			policy: feePolicy{GasAdjustment: 1, GasPrices: sdk.NewDecCoins(sdk.NewDecCoinFromDec("uregen", sdk.MustNewDecFromStr("0.1")), sdk.NewDecCoin("ufree", sdk.ZeroInt()))},
+			used:   1000,
+			gas:    1000,
+			fees:   sdk.NewCoins(sdk.NewInt64Coin("uregen", 100)),
+		},
+		{
+			name:   "fixed gas limit",
+			policy: feePolicy{GasLimit: 200000, GasAdjustment: 1.5, GasPrices: prices},
+			gas:    200000,
+			fees:   sdk.NewCoins(sdk.NewInt64Coin("uatom", 5000), sdk.NewInt64Coin("uregen", 20000)),
+		},
+		{
+			name:   "fixed fees",
+			policy: feePolicy{GasAdjustment: 1.5, Fees: sdk.NewCoins(sdk.NewInt64Coin("uregen", 5000)), GasPrices: prices},
+			used:   100000,
+			gas:    150000,
+			fees:   sdk.NewCoins(sdk.NewInt64Coin("uregen", 5000)),
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			gas := tc.policy.GasLimit
+
+			if gas == 0 {
+				gas = tc.policy.adjustGas(tc.used)
+			}
+
+			require.Equal(t, tc.gas, gas)
+
+			fees := tc.policy.fees(gas)
+			require.NoError(t, fees.Validate())
+			require.True(t, tc.fees.IsEqual(fees), "fees %s, expected %s", fees, tc.fees)
+		})
+	}
+}
+
+func TestSetFeeFixedGas(t *testing.T) {
+	txBuilder := makeEncodingConfig().TxConfig.NewTxBuilder()
+	policy := &feePolicy{GasLimit: 200000, GasPrices: sdk.NewDecCoins(sdk.NewDecCoinFromDec("uregen", sdk.MustNewDecFromStr("0.1")))}
+
+	// No simulation is needed, so there is no chain to connect to
+	c := &chainClient{}
+	require.NoError(t, c.setFee(txBuilder, policy, nil, 0))
+
+	require.Equal(t, uint64(200000), txBuilder.GetTx().GetGas())
+	require.True(t, sdk.NewCoins(sdk.NewInt64Coin("uregen", 20000)).IsEqual(txBuilder.GetTx().GetFee()))
+}